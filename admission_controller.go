@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	simplejson "encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -40,26 +42,28 @@ type patchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
 	Value interface{} `json:"value,omitempty"`
+
+	// warning is returned to the client along with the response, if set, but not part of the patch.
+	warning string
+}
+
+// forbiddenError is the error returned by an admitFunc to deny a request which does not comply with a policy.
+type forbiddenError struct {
+	message string
+}
+
+func (e *forbiddenError) Error() string {
+	return e.message
 }
 
 // admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
 // operations to be applied in case of success, or the error that will be shown when the operation is rejected.
 type admitFunc func(*admissionv1.AdmissionRequest) ([]patchOperation, error)
 
-// isExcludedNamespace checks if the given namespace is a excluded via the configuration.
-func isExcludedNamespace(ns string, excludedNamespaces []string) bool {
-	for _, a := range excludedNamespaces {
-		if a == ns {
-			return true
-		}
-	}
-	return false
-}
-
 // doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
 // request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
 // bytes.
-func (wh *mutationWH) doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) (runtime.Object, error) {
+func (wh *mutationWH) doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc, isExcluded func(ns string) bool) (runtime.Object, error) {
 	// Step 1: Request validation. Only handle POST requests with a body and json content type.
 
 	if r.Method != http.MethodPost {
@@ -111,7 +115,7 @@ func (wh *mutationWH) doServeAdmitFunc(w http.ResponseWriter, r *http.Request, a
 
 		// Apply the admit() function only for non-excluded namespaces. For objects excluded, return
 		// an empty set of patch operations.
-		if !isExcludedNamespace(admissionReviewReq.Request.Namespace, wh.excludedNamespaces) {
+		if !isExcluded(admissionReviewReq.Request.Namespace) {
 			patchOps, err = admit(admissionReviewReq.Request)
 		} else {
 			log.Debugf("Namespace is excluded")
@@ -125,6 +129,13 @@ func (wh *mutationWH) doServeAdmitFunc(w http.ResponseWriter, r *http.Request, a
 				Message: err.Error(),
 				Reason:  metav1.StatusReasonBadRequest,
 			}
+			var forbidden *forbiddenError
+			if errors.As(err, &forbidden) {
+				admissionReviewResponse.Response.Result.Reason = metav1.StatusReasonForbidden
+				admissionReviewResponse.Response.Result.Code = http.StatusForbidden
+			}
+			// The error is part of the response, the response itself is valid.
+			err = nil
 		} else {
 			// Otherwise, encode the patch operations to JSON and return a positive response.
 			patchBytes, err := simplejson.Marshal(patchOps)
@@ -137,22 +148,45 @@ func (wh *mutationWH) doServeAdmitFunc(w http.ResponseWriter, r *http.Request, a
 				}
 			} else {
 				admissionReviewResponse.Response.Allowed = true
-				admissionReviewResponse.Response.Patch = patchBytes
-				admissionReviewResponse.Response.PatchType = &patchType
+				admissionReviewResponse.Response.Warnings = patchWarnings(patchOps)
+				admissionReviewResponse.Response.AuditAnnotations = patchAuditAnnotations(patchOps)
+				recordPatches(patchOps)
+				// A validating webhook may not return any patch.
+				if len(patchOps) > 0 {
+					admissionReviewResponse.Response.Patch = patchBytes
+					admissionReviewResponse.Response.PatchType = &patchType
+				}
 			}
 		}
 	}
 
+	recordAdmission(admissionReviewReq.Request, admissionReviewResponse.Response)
+
 	// Return the AdmissionReview with a response as JSON.
 	return &admissionReviewResponse, err
 }
 
+// patchWarnings returns the distinct warnings of the given patch operations, in order.
+func patchWarnings(patchOps []patchOperation) []string {
+	var warnings []string
+	for _, p := range patchOps {
+		if p.warning != "" && !contains(warnings, p.warning) {
+			warnings = append(warnings, p.warning)
+		}
+	}
+	return warnings
+}
+
 // serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging.
-func (wh *mutationWH) serveAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) {
+func (wh *mutationWH) serveAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc, isExcluded func(ns string) bool) {
 	log.Tracef("Webhook request starts...")
+	start := time.Now()
 
 	var writeErr error
-	if object, err := wh.doServeAdmitFunc(w, r, admit); err != nil {
+	object, err := wh.doServeAdmitFunc(w, r, admit, isExcluded)
+	admissionDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		recordAdmission(nil, nil)
 		log.Printf("Error handling webhook request: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, writeErr = w.Write([]byte(err.Error()))
@@ -172,13 +206,15 @@ func (wh *mutationWH) serveAdmitFunc(w http.ResponseWriter, r *http.Request, adm
 	log.Tracef("...Webhook request ends")
 }
 
-// admitFuncHandler takes an admitFunc and wraps it into a http.Handler by means of calling serveAdmitFunc.
-func (wh *mutationWH) admitFuncHandler(admit admitFunc) http.Handler {
-
-	//Some initialisation...
+func init() {
+	// Registered once at startup, as the handlers are created for each request, see webhookServer.currentHandler.
 	scheme.AddKnownTypes(groupVersion, &admissionv1.AdmissionReview{})
+}
 
+// admitFuncHandler takes an admitFunc and wraps it into a http.Handler by means of calling serveAdmitFunc.
+// The admitFunc is not applied on the namespaces for which isExcluded returns true.
+func (wh *mutationWH) admitFuncHandler(admit admitFunc, isExcluded func(ns string) bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		wh.serveAdmitFunc(w, r, admit)
+		wh.serveAdmitFunc(w, r, admit, isExcluded)
 	})
 }
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestIsExcludedNamespace(t *testing.T) {
@@ -14,3 +22,153 @@ func TestIsExcludedNamespace(t *testing.T) {
 	assert.False(t, isExcludedNamespace("ns", []string{}))
 	assert.False(t, isExcludedNamespace("ns", nil))
 }
+
+func postAdmissionReview(t *testing.T, handler http.Handler, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", jsonContentType)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	review := admissionv1.AdmissionReview{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &review))
+	assert.NotNil(t, review.Response)
+	assert.Equal(t, req.UID, review.Response.UID)
+	return review.Response
+}
+
+func TestServeValidateDenied(t *testing.T) {
+
+	wh := mutationWH{
+		allowedRegistries: []string{"harbor.corp"},
+	}
+
+	raw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "quay.io/a:v"},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	response := postAdmissionReview(t, wh.admitFuncHandler(wh.validateImages, wh.isExcludedFromValidation), &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Resource:  podResource,
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	assert.False(t, response.Allowed)
+	assert.Nil(t, response.Patch)
+	assert.Equal(t, metav1.StatusReasonForbidden, response.Result.Reason)
+	assert.Equal(t, int32(http.StatusForbidden), response.Result.Code)
+	assert.Contains(t, response.Result.Message, `container "app" image "quay.io/a:v"`)
+
+	// Excluded namespaces are not validated.
+	wh.validationExcludedNamespaces = []string{"ns"}
+	response = postAdmissionReview(t, wh.admitFuncHandler(wh.validateImages, wh.isExcludedFromValidation), &admissionv1.AdmissionRequest{
+		UID:       "uid-2",
+		Resource:  podResource,
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	assert.True(t, response.Allowed)
+	assert.Nil(t, response.Patch)
+}
+
+func TestServeMutate(t *testing.T) {
+
+	wh := mutationWH{
+		registry: "x.y",
+	}
+
+	raw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "a:v"},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	response := postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Resource:  podResource,
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	assert.True(t, response.Allowed)
+	assert.Equal(t, admissionv1.PatchTypeJSONPatch, *response.PatchType)
+	assert.JSONEq(t, `[{"op":"replace","path":"/spec/containers/0/image","value":"x.y/a:v"}]`, string(response.Patch))
+}
+
+func TestServeMutateWarnings(t *testing.T) {
+
+	wh := mutationWH{
+		registry:               "x.y",
+		imagePullSecret:        "harbor",
+		forceImagePullPolicy:   true,
+		imagePullPolicyToForce: corev1.PullAlways,
+		mutationWarnings:       true,
+	}
+
+	raw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "a:v", ImagePullPolicy: corev1.PullIfNotPresent},
+				{Name: "sidecar", Image: "x.y/b:v", ImagePullPolicy: corev1.PullAlways},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	req := &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Resource:  podResource,
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	response := postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), req)
+	assert.True(t, response.Allowed)
+	assert.Equal(t, []string{
+		`container "app" image "a:v" replaced by "x.y/a:v"`,
+		`container "app" imagePullPolicy IfNotPresent replaced by Always`,
+		`pull secret(s) harbor injected`,
+	}, response.Warnings)
+
+	// The warnings are disabled by default.
+	wh.mutationWarnings = false
+	response = postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), req)
+	assert.True(t, response.Allowed)
+	assert.Empty(t, response.Warnings)
+	assert.NotEmpty(t, response.Patch)
+}
+
+func TestServeMutatePvcWarnings(t *testing.T) {
+
+	wh := mutationWH{
+		defaultStorageClass: "rook-ceph-block",
+		mutationWarnings:    true,
+	}
+
+	storageClass := "gp2"
+	raw, err := json.Marshal(corev1.PersistentVolumeClaim{
+		Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass},
+	})
+	assert.Nil(t, err)
+
+	response := postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Resource:  volumeClaimResource,
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	assert.True(t, response.Allowed)
+	assert.Equal(t, []string{`storage class "gp2" replaced by "rook-ceph-block"`}, response.Warnings)
+}
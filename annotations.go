@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// annotationPrefix is the prefix of all the annotations read by the webhook.
+	annotationPrefix = "mutate-image.sqooba.io/"
+
+	// skipAnnotation opts the object out of all the mutations.
+	skipAnnotation = annotationPrefix + "skip"
+	// skipRegistryAnnotation opts the object out of the rewriting of the images.
+	skipRegistryAnnotation = annotationPrefix + "skip-registry"
+	// skipPullPolicyAnnotation opts the object out of the forcing of the pull policy.
+	skipPullPolicyAnnotation = annotationPrefix + "skip-pull-policy"
+	// skipPullSecretAnnotation opts the object out of the injection of the pull secret.
+	skipPullSecretAnnotation = annotationPrefix + "skip-pull-secret"
+	// skipContainersAnnotation is a comma separated list of the containers whose image and pull policy are not mutated.
+	skipContainersAnnotation = annotationPrefix + "skip-containers"
+	// mutateAnnotation opts the object in for the mutations, when the opt-in mode is enabled.
+	mutateAnnotation = annotationPrefix + "mutate"
+	// originalAnnotation records the original images, pull policies and pull secrets of a pod, see originalSpec.
+	originalAnnotation = annotationPrefix + "original"
+)
+
+// mutationOptions tells which mutations are skipped for an object, as requested via its annotations,
+// along with the policies depending on its namespace.
+type mutationOptions struct {
+	skip           bool
+	skipRegistry   bool
+	skipPullPolicy bool
+	skipPullSecret bool
+	skipContainers []string
+
+	namespace       string
+	latestTagPolicy latestTagPolicy
+}
+
+// skipsContainer returns true if the image and pull policy of the given container are not mutated.
+func (o mutationOptions) skipsContainer(name string) bool {
+	for _, c := range o.skipContainers {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mutationOptions returns the mutations to skip for the object with the given metadata, whose namespace
+// must be set. In opt-in mode, the objects not annotated with mutateAnnotation skip all the mutations.
+// The opt-out annotations are only honoured in the namespaces allowed to opt out, and ignored otherwise.
+func (wh *mutationWH) mutationOptions(meta metav1.ObjectMeta) mutationOptions {
+
+	if wh.optIn && !isAnnotationTrue(meta, mutateAnnotation) {
+		log.Debugf("Object %s/%s did not opt in, skipping the mutations", meta.Namespace, meta.Name)
+		return mutationOptions{skip: true}
+	}
+
+	options := mutationOptions{
+		skip:            isAnnotationTrue(meta, skipAnnotation),
+		skipRegistry:    isAnnotationTrue(meta, skipRegistryAnnotation),
+		skipPullPolicy:  isAnnotationTrue(meta, skipPullPolicyAnnotation),
+		skipPullSecret:  isAnnotationTrue(meta, skipPullSecretAnnotation),
+		namespace:       meta.Namespace,
+		latestTagPolicy: wh.latestTagPolicyFor(meta.Namespace),
+	}
+	for _, c := range strings.Split(meta.Annotations[skipContainersAnnotation], ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			options.skipContainers = append(options.skipContainers, c)
+		}
+	}
+
+	optsOut := options.skip || options.skipRegistry || options.skipPullPolicy || options.skipPullSecret || len(options.skipContainers) > 0
+	if optsOut && !isExcludedNamespace(meta.Namespace, wh.optOutNamespaces) {
+		log.Printf("Object %s/%s is annotated to opt out of mutations, but namespace %s is not allowed to, ignoring the annotations",
+			meta.Namespace, meta.Name, meta.Namespace)
+		return mutationOptions{namespace: options.namespace, latestTagPolicy: options.latestTagPolicy}
+	}
+	return options
+}
+
+// isAnnotationTrue returns true if the given annotation of the object is set to a true boolean value.
+func isAnnotationTrue(meta metav1.ObjectMeta, annotation string) bool {
+	value, ok := meta.Annotations[annotation]
+	if !ok {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Annotation %s of %s/%s is not a boolean: %s, ignoring it", annotation, meta.Namespace, meta.Name, value)
+		return false
+	}
+	return b
+}
+
+// originalSpec is the content of originalAnnotation, recording the values of a pod spec before they
+// have been mutated, i.e. the original image and pull policy of the containers, by container name,
+// and the original pull secrets. Values which have not been mutated are not recorded.
+type originalSpec struct {
+	Images            map[string]string              `json:"images,omitempty"`
+	ImagePullPolicies map[string]corev1.PullPolicy   `json:"imagePullPolicies,omitempty"`
+	ImagePullSecrets  *[]corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+}
+
+// recordImage records the original image of the container, unless it is not recorded.
+func (o *originalSpec) recordImage(container string, image string) {
+	if o == nil {
+		return
+	}
+	if o.Images == nil {
+		o.Images = map[string]string{}
+	}
+	o.Images[container] = image
+}
+
+// recordImagePullPolicy records the original pull policy of the container, unless it is not recorded.
+func (o *originalSpec) recordImagePullPolicy(container string, policy corev1.PullPolicy) {
+	if o == nil {
+		return
+	}
+	if o.ImagePullPolicies == nil {
+		o.ImagePullPolicies = map[string]corev1.PullPolicy{}
+	}
+	o.ImagePullPolicies[container] = policy
+}
+
+// originalAnnotationPatch returns the patch operation recording the given original values of the pod spec
+// in the originalAnnotation of the given metadata, located at the given path, and whether it is needed.
+// The values already recorded by a previous mutation, i.e. on update, are kept unless mutated again,
+// such that mutating an already mutated pod does not change its annotation.
+func originalAnnotationPatch(meta metav1.ObjectMeta, spec corev1.PodSpec, path string, original originalSpec) (patchOperation, bool) {
+
+	current, annotated := meta.Annotations[originalAnnotation]
+
+	recorded := originalSpec{}
+	if annotated {
+		if err := json.Unmarshal([]byte(current), &recorded); err != nil {
+			log.Printf("Annotation %s of %s/%s is not valid, overwriting it: %v", originalAnnotation, meta.Namespace, meta.Name, err)
+			recorded = originalSpec{}
+		}
+	}
+
+	// Only keep the values of the containers still in the pod.
+	for _, c := range append(append([]corev1.Container(nil), spec.InitContainers...), spec.Containers...) {
+		if image, ok := recorded.Images[c.Name]; ok {
+			if _, mutated := original.Images[c.Name]; !mutated {
+				original.recordImage(c.Name, image)
+			}
+		}
+		if policy, ok := recorded.ImagePullPolicies[c.Name]; ok {
+			if _, mutated := original.ImagePullPolicies[c.Name]; !mutated {
+				original.recordImagePullPolicy(c.Name, policy)
+			}
+		}
+	}
+	if original.ImagePullSecrets == nil {
+		original.ImagePullSecrets = recorded.ImagePullSecrets
+	}
+
+	if original.Images == nil && original.ImagePullPolicies == nil && original.ImagePullSecrets == nil {
+		return patchOperation{}, false
+	}
+	value, err := json.Marshal(original)
+	if err != nil {
+		log.Errorf("Could not serialize the original values of %s/%s: %v", meta.Namespace, meta.Name, err)
+		return patchOperation{}, false
+	}
+	if annotated && string(value) == current {
+		return patchOperation{}, false
+	}
+
+	if meta.Annotations == nil {
+		return patchOperation{
+			Op:    "add",
+			Path:  path + "/metadata/annotations",
+			Value: map[string]string{originalAnnotation: string(value)},
+		}, true
+	}
+	// The add operation replaces the annotation if it already exists.
+	return patchOperation{
+		Op:    "add",
+		Path:  path + "/metadata/annotations/" + escapeJSONPointer(originalAnnotation),
+		Value: string(value),
+	}, true
+}
+
+// escapeJSONPointer escapes the given key to be used in a JSON pointer, i.e. the path of a patch operation.
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
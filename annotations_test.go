@@ -0,0 +1,244 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func annotatedPod(namespace string, annotations map[string]string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: namespace, Annotations: annotations},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "a:v", ImagePullPolicy: corev1.PullIfNotPresent},
+				{Name: "sidecar", Image: "b:v", ImagePullPolicy: corev1.PullIfNotPresent},
+			},
+		},
+	}
+}
+
+func annotatedMutationWH() mutationWH {
+	return mutationWH{
+		registry:               "x.y",
+		imagePullSecret:        "s1",
+		forceImagePullPolicy:   true,
+		imagePullPolicyToForce: corev1.PullAlways,
+		defaultStorageClass:    "sc",
+		optOutNamespaces:       []string{"team-*"},
+	}
+}
+
+func TestSkipAnnotation(t *testing.T) {
+	wh := annotatedMutationWH()
+
+	patches, err := wh.applyMutationOnPod(annotatedPod("team-a", map[string]string{skipAnnotation: "true"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	patches, err = wh.applyMutationOnPod(annotatedPod("team-a", map[string]string{skipAnnotation: "false"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(patches))
+
+	patches, err = wh.applyMutationOnPod(annotatedPod("team-a", map[string]string{skipAnnotation: "not-a-bool"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(patches))
+}
+
+func TestSkipAnnotationNotAllowedNamespace(t *testing.T) {
+	wh := annotatedMutationWH()
+
+	patches, err := wh.applyMutationOnPod(annotatedPod("production", map[string]string{skipAnnotation: "true"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(patches))
+
+	// Without allowlist, no namespace can opt out.
+	wh.optOutNamespaces = nil
+	patches, err = wh.applyMutationOnPod(annotatedPod("team-a", map[string]string{skipAnnotation: "true"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(patches))
+}
+
+func TestSkipRegistryAndPullPolicyAnnotations(t *testing.T) {
+	wh := annotatedMutationWH()
+
+	patches, err := wh.applyMutationOnPod(annotatedPod("team-a", map[string]string{skipRegistryAnnotation: "true"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/imagePullPolicy", Value: corev1.PullAlways},
+		{Op: "replace", Path: "/spec/containers/1/imagePullPolicy", Value: corev1.PullAlways},
+		{Op: "add", Path: "/spec/imagePullSecrets", Value: []map[string]string{{"name": "s1"}}},
+	}, patches)
+
+	patches, err = wh.applyMutationOnPod(annotatedPod("team-a", map[string]string{
+		skipPullPolicyAnnotation: "true",
+		skipPullSecretAnnotation: "true",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: "x.y/a:v"},
+		{Op: "replace", Path: "/spec/containers/1/image", Value: "x.y/b:v"},
+	}, patches)
+}
+
+func TestSkipContainersAnnotation(t *testing.T) {
+	wh := annotatedMutationWH()
+
+	patches, err := wh.applyMutationOnPod(annotatedPod("team-a", map[string]string{skipContainersAnnotation: "sidecar, debug"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: "x.y/a:v"},
+		{Op: "replace", Path: "/spec/containers/0/imagePullPolicy", Value: corev1.PullAlways},
+		{Op: "add", Path: "/spec/imagePullSecrets", Value: []map[string]string{{"name": "s1"}}},
+	}, patches)
+}
+
+func TestOptInMode(t *testing.T) {
+	wh := annotatedMutationWH()
+	wh.optIn = true
+	wh.optOutNamespaces = nil
+
+	patches, err := wh.applyMutationOnPod(annotatedPod("production", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	patches, err = wh.applyMutationOnPod(annotatedPod("production", map[string]string{mutateAnnotation: "true"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(patches))
+
+	pvc := corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "production"}}
+	patches, err = wh.applyMutationOnPvc(pvc)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
+func TestSkipAnnotationPvc(t *testing.T) {
+	wh := annotatedMutationWH()
+
+	pvc := corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "team-a",
+		Annotations: map[string]string{skipAnnotation: "true"},
+	}}
+	patches, err := wh.applyMutationOnPvc(pvc)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	pvc.Namespace = "production"
+	patches, err = wh.applyMutationOnPvc(pvc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+}
+
+func TestSkipAnnotationPodTemplate(t *testing.T) {
+	wh := annotatedMutationWH()
+	wh.mutateWorkloads = true
+
+	deployment := appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{skipAnnotation: "true"}},
+				Spec:       annotatedPod("", nil).Spec,
+			},
+		},
+	}
+
+	req := workloadRequest(t, deployment, deploymentResource)
+	req.Namespace = "team-a"
+	patches, err := wh.applyMutations(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	req.Namespace = "production"
+	patches, err = wh.applyMutations(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(patches))
+}
+
+func TestSkipAnnotationRequestNamespace(t *testing.T) {
+	wh := annotatedMutationWH()
+
+	// The namespace of a pod is not set on creation, the one of the request is used.
+	req := workloadRequest(t, annotatedPod("", map[string]string{skipAnnotation: "true"}), podResource)
+	req.Namespace = "team-a"
+	patches, err := wh.applyMutations(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
+func TestRecordOriginal(t *testing.T) {
+	wh := annotatedMutationWH()
+	wh.recordOriginal = true
+
+	pod := annotatedPod("production", nil)
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "s0"}}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(patches))
+	assert.Equal(t, patchOperation{
+		Op:    "add",
+		Path:  "/metadata/annotations",
+		Value: map[string]string{originalAnnotation: `{"images":{"app":"a:v","sidecar":"b:v"},"imagePullPolicies":{"app":"IfNotPresent","sidecar":"IfNotPresent"},"imagePullSecrets":[{"name":"s0"}]}`},
+	}, patches[5])
+}
+
+func TestRecordOriginalIdempotent(t *testing.T) {
+	wh := annotatedMutationWH()
+	wh.recordOriginal = true
+
+	// The pod as mutated on creation, being updated.
+	pod := annotatedPod("production", map[string]string{
+		originalAnnotation: `{"images":{"app":"a:v","sidecar":"b:v"},"imagePullPolicies":{"app":"IfNotPresent","sidecar":"IfNotPresent"},"imagePullSecrets":[]}`,
+	})
+	pod.Spec.Containers[0].Image = "x.y/a:v"
+	pod.Spec.Containers[1].Image = "x.y/b:v"
+	pod.Spec.Containers[0].ImagePullPolicy = corev1.PullAlways
+	pod.Spec.Containers[1].ImagePullPolicy = corev1.PullAlways
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "s1"}}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	// Updating the image of a container records its new original image only.
+	pod.Spec.Containers[1].Image = "b:v2"
+	patches, err = wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/1/image", Value: "x.y/b:v2"},
+		{
+			Op:    "add",
+			Path:  "/metadata/annotations/mutate-image.sqooba.io~1original",
+			Value: `{"images":{"app":"a:v","sidecar":"b:v2"},"imagePullPolicies":{"app":"IfNotPresent","sidecar":"IfNotPresent"},"imagePullSecrets":[]}`,
+		},
+	}, patches)
+}
+
+func TestRecordOriginalPodTemplate(t *testing.T) {
+	wh := mutationWH{
+		registry:        "x.y",
+		mutateWorkloads: true,
+		recordOriginal:  true,
+	}
+
+	deployment := appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"a": "b"}},
+				Spec:       annotatedPod("", nil).Spec,
+			},
+		},
+	}
+
+	patches, err := wh.applyMutations(workloadRequest(t, deployment, deploymentResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(patches))
+	assert.Equal(t, patchOperation{
+		Op:    "add",
+		Path:  "/spec/template/metadata/annotations/mutate-image.sqooba.io~1original",
+		Value: `{"images":{"app":"a:v","sidecar":"b:v"}}`,
+	}, patches[2])
+}
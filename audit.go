@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mutationType is the type of mutation a patch operation performs, summarized in the audit annotations.
+type mutationType string
+
+const (
+	// mutationImage rewrites the image of a container.
+	mutationImage mutationType = "image"
+	// mutationPullPolicy sets the pull policy of a container.
+	mutationPullPolicy mutationType = "pull-policy"
+	// mutationPullSecret injects pull secrets.
+	mutationPullSecret mutationType = "pull-secret"
+	// mutationStorageClass sets the storage class of a pvc or pvc template.
+	mutationStorageClass mutationType = "storage-class"
+	// mutationOriginal records the original values in originalAnnotation.
+	mutationOriginal mutationType = "original"
+)
+
+// mutation returns the type of mutation the patch operation performs, given by the field it patches.
+func (p patchOperation) mutation() mutationType {
+	switch {
+	case strings.HasSuffix(p.Path, "/image"):
+		return mutationImage
+	case strings.HasSuffix(p.Path, "/imagePullPolicy"):
+		return mutationPullPolicy
+	case strings.Contains(p.Path, "/imagePullSecrets"):
+		return mutationPullSecret
+	case strings.HasSuffix(p.Path, "/storageClassName"):
+		return mutationStorageClass
+	case strings.Contains(p.Path, "/metadata/annotations"):
+		return mutationOriginal
+	}
+	return ""
+}
+
+const (
+	// imagesRewrittenAuditAnnotation is the number of images rewritten.
+	imagesRewrittenAuditAnnotation = "images-rewritten"
+	// pullPoliciesChangedAuditAnnotation is the number of pull policies set.
+	pullPoliciesChangedAuditAnnotation = "pull-policies-changed"
+	// pullSecretsAuditAnnotation is the comma separated list of the pull secrets injected.
+	pullSecretsAuditAnnotation = "pull-secrets-injected"
+	// storageClassAuditAnnotation is the comma separated list of the storage classes set.
+	storageClassAuditAnnotation = "storage-class"
+)
+
+// patchAuditAnnotations returns the audit annotations summarizing the mutations performed by the given
+// patch operations, such as images-rewritten=3 or storage-class=rook-ceph-block, recorded by the API server
+// in the audit log, prefixed with the name of the webhook. Nil is returned if nothing has been mutated.
+func patchAuditAnnotations(patchOps []patchOperation) map[string]string {
+	var images, pullPolicies int
+	var pullSecrets, storageClasses []string
+
+	for _, p := range patchOps {
+		switch p.mutation() {
+		case mutationImage:
+			images++
+		case mutationPullPolicy:
+			pullPolicies++
+		case mutationPullSecret:
+			for _, s := range patchedPullSecrets(p.Value) {
+				if !contains(pullSecrets, s) {
+					pullSecrets = append(pullSecrets, s)
+				}
+			}
+		case mutationStorageClass:
+			if s, ok := p.Value.(string); ok && !contains(storageClasses, s) {
+				storageClasses = append(storageClasses, s)
+			}
+		}
+	}
+
+	annotations := map[string]string{}
+	if images > 0 {
+		annotations[imagesRewrittenAuditAnnotation] = strconv.Itoa(images)
+	}
+	if pullPolicies > 0 {
+		annotations[pullPoliciesChangedAuditAnnotation] = strconv.Itoa(pullPolicies)
+	}
+	if len(pullSecrets) > 0 {
+		sort.Strings(pullSecrets)
+		annotations[pullSecretsAuditAnnotation] = strings.Join(pullSecrets, ",")
+	}
+	if len(storageClasses) > 0 {
+		sort.Strings(storageClasses)
+		annotations[storageClassAuditAnnotation] = strings.Join(storageClasses, ",")
+	}
+
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
+
+// patchedPullSecrets returns the names of the pull secrets of the value of a patch operation injecting pull secrets,
+// i.e. either a list of references, or a single reference appended to the list.
+func patchedPullSecrets(value interface{}) []string {
+	var names []string
+	switch v := value.(type) {
+	case []map[string]string:
+		for _, reference := range v {
+			names = append(names, reference["name"])
+		}
+	case map[string]string:
+		names = append(names, v["name"])
+	}
+	return names
+}
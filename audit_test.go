@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPatchMutation(t *testing.T) {
+	for path, mutation := range map[string]mutationType{
+		"/spec/containers/0/image":                           mutationImage,
+		"/spec/template/spec/initContainers/1/image":         mutationImage,
+		"/spec/ephemeralContainers/0/imagePullPolicy":        mutationPullPolicy,
+		"/spec/imagePullSecrets":                             mutationPullSecret,
+		"/spec/imagePullSecrets/-":                           mutationPullSecret,
+		"/imagePullSecrets":                                  mutationPullSecret,
+		"/spec/storageClassName":                             mutationStorageClass,
+		"/spec/volumeClaimTemplates/0/spec/storageClassName": mutationStorageClass,
+		"/metadata/annotations":                              mutationOriginal,
+		"/spec/template/metadata/annotations/a~1b":           mutationOriginal,
+		"/spec/other":                                        "",
+	} {
+		assert.Equal(t, mutation, patchOperation{Path: path}.mutation(), path)
+	}
+}
+
+func TestPatchAuditAnnotations(t *testing.T) {
+	assert.Nil(t, patchAuditAnnotations(nil))
+	assert.Nil(t, patchAuditAnnotations([]patchOperation{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}}}))
+
+	assert.Equal(t, map[string]string{
+		imagesRewrittenAuditAnnotation:     "2",
+		pullPoliciesChangedAuditAnnotation: "1",
+		pullSecretsAuditAnnotation:         "harbor,quay",
+		storageClassAuditAnnotation:        "rook-ceph-block",
+	}, patchAuditAnnotations([]patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: "x.y/a:v"},
+		{Op: "replace", Path: "/spec/containers/1/image", Value: "x.y/b:v"},
+		{Op: "replace", Path: "/spec/containers/0/imagePullPolicy", Value: corev1.PullAlways},
+		{Op: "add", Path: "/spec/imagePullSecrets/-", Value: map[string]string{"name": "quay"}},
+		{Op: "add", Path: "/spec/imagePullSecrets/-", Value: map[string]string{"name": "harbor"}},
+		{Op: "add", Path: "/spec/volumes/0/ephemeral/volumeClaimTemplate/spec/storageClassName", Value: "rook-ceph-block"},
+		{Op: "add", Path: "/spec/volumes/1/ephemeral/volumeClaimTemplate/spec/storageClassName", Value: "rook-ceph-block"},
+	}))
+}
+
+func TestServeMutateAuditAnnotations(t *testing.T) {
+
+	wh := mutationWH{
+		registry:        "x.y",
+		imagePullSecret: "harbor",
+	}
+
+	raw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "a:v"},
+				{Name: "sidecar", Image: "b:v"},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	response := postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Resource:  podResource,
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	assert.True(t, response.Allowed)
+	assert.Equal(t, map[string]string{
+		imagesRewrittenAuditAnnotation: "2",
+		pullSecretsAuditAnnotation:     "harbor",
+	}, response.AuditAnnotations)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// The keys of the TLS secret, the same as the ones of the secret created by generate-certs-and-config.sh.
+	caCertSecretKey  = "ca.crt"
+	caKeySecretKey   = "ca.key"
+	tlsCertSecretKey = "webhook-server-tls.crt"
+	tlsKeySecretKey  = "webhook-server-tls.key"
+	// caBundleSecretKey holds the caBundle of the webhook configurations, i.e. the current CA followed by
+	// the previous one after a CA rotation, such that the certificates it signed are trusted until renewed.
+	caBundleSecretKey = "ca-bundle.crt"
+
+	// caValidity is the validity of the generated CA, which is renewed along with the serving certificate
+	// when it would expire before it.
+	caValidity = 10 * 365 * 24 * time.Hour
+	// caCommonName is the common name of the generated CA.
+	caCommonName = "Sqooba k8s-mutate-image-and-policy-webhook CA"
+)
+
+// certBootstrapper generates the CA and the serving certificate of the webhook, stores them in a secret,
+// shared by all the replicas, and patches the caBundle of the webhook configurations with the CA.
+// The serving certificate is renewed, signed by the same CA, before it expires.
+type certBootstrapper struct {
+	client kubernetes.Interface
+	// secret holds the CA and the serving certificate, along with their keys.
+	secret types.NamespacedName
+	// dnsNames are the names of the service of the webhook the serving certificate is valid for.
+	dnsNames []string
+	// mutatingWebhooks and validatingWebhooks are the names of the webhook configurations whose caBundle is patched.
+	mutatingWebhooks   []string
+	validatingWebhooks []string
+	// validity is the validity of the serving certificate, which is renewed renewBefore its expiry.
+	validity    time.Duration
+	renewBefore time.Duration
+	now         func() time.Time
+
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+// getCertificate returns the current serving certificate, to be used as tls.Config.GetCertificate.
+func (b *certBootstrapper) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := b.certificate.Load(); c != nil {
+		return c, nil
+	}
+	return nil, errors.New("the serving certificate has not been bootstrapped yet")
+}
+
+// run reconciles the certificates every interval, until the stop channel is closed, such that the serving
+// certificate is renewed before it expires, or loaded when renewed by another replica, and the caBundle
+// is patched when the webhook configurations are created or updated.
+func (b *certBootstrapper) run(interval time.Duration, stop <-chan struct{}) {
+	pollEvery(interval, stop, func() {
+		if err := b.reconcile(context.Background()); err != nil {
+			log.Errorf("Could not reconcile the certificates, keeping the current ones: %v", err)
+		}
+	})
+}
+
+// reconcile loads the certificates from the secret, generating them if they are missing, invalid or about to
+// expire, patches the caBundle of the webhook configurations, and then serves the serving certificate, such that
+// it is trusted by the API server once served.
+func (b *certBootstrapper) reconcile(ctx context.Context) error {
+
+	data, err := b.ensureSecret(ctx)
+	if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+		// Another replica wrote the secret meanwhile, use its certificates.
+		log.Debugf("Secret %s has been written by another replica, reloading it", b.secret)
+		data, err = b.ensureSecret(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.X509KeyPair(data[tlsCertSecretKey], data[tlsKeySecretKey])
+	if err != nil {
+		return fmt.Errorf("could not load the serving certificate: %v", err)
+	}
+	if err := b.patchCABundles(ctx, caBundle(data)); err != nil {
+		return err
+	}
+	if current := b.certificate.Load(); current == nil || !bytes.Equal(current.Certificate[0], certificate.Certificate[0]) {
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return fmt.Errorf("could not parse the serving certificate: %v", err)
+		}
+		b.certificate.Store(&certificate)
+		certificateReloads.WithLabelValues("success").Inc()
+		recordCertificateExpiry(certificate.Leaf.NotAfter)
+		log.Printf("Serving certificate loaded from secret %s, valid until %s", b.secret, certificate.Leaf.NotAfter)
+	}
+
+	return nil
+}
+
+// caBundle returns the caBundle of the given secret data, or its CA if it has no caBundle, such as the secret
+// created by generate-certs-and-config.sh.
+func caBundle(data map[string][]byte) []byte {
+	if bundle := data[caBundleSecretKey]; len(bundle) > 0 {
+		return bundle
+	}
+	return data[caCertSecretKey]
+}
+
+// ensureSecret returns the content of the secret, after having generated the certificates if they are not valid.
+func (b *certBootstrapper) ensureSecret(ctx context.Context) (map[string][]byte, error) {
+
+	secrets := b.client.CoreV1().Secrets(b.secret.Namespace)
+	secret, err := secrets.Get(ctx, b.secret.Name, metav1.GetOptions{})
+	notFound := apierrors.IsNotFound(err)
+	if err != nil && !notFound {
+		return nil, fmt.Errorf("could not get secret %s: %v", b.secret, err)
+	}
+	var current map[string][]byte
+	if !notFound {
+		current = secret.Data
+		err := b.validate(current)
+		if err == nil {
+			return current, nil
+		}
+		log.Printf("Certificates of secret %s have to be renewed: %v", b.secret, err)
+	}
+
+	data, err := b.generate(current)
+	if err != nil {
+		return nil, err
+	}
+	if notFound {
+		_, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      b.secret.Name,
+				Namespace: b.secret.Namespace,
+				Labels:    map[string]string{managedByLabel: managedByValue},
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+	} else {
+		secret.Data = data
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Certificates generated and stored in secret %s", b.secret)
+	return data, nil
+}
+
+// validate returns an error if the serving certificate of the given secret data is not signed by its CA,
+// is not valid for all the DNS names, or expires, along with its CA, within renewBefore.
+func (b *certBootstrapper) validate(data map[string][]byte) error {
+	if _, err := tls.X509KeyPair(data[tlsCertSecretKey], data[tlsKeySecretKey]); err != nil {
+		return fmt.Errorf("invalid serving certificate: %v", err)
+	}
+	certificate, err := parseCertificate(data[tlsCertSecretKey])
+	if err != nil {
+		return fmt.Errorf("invalid serving certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data[caCertSecretKey]) {
+		return errors.New("invalid CA certificate")
+	}
+	for _, name := range b.dnsNames {
+		if _, err := certificate.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			DNSName:     name,
+			CurrentTime: b.now().Add(b.renewBefore),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generate returns the secret data holding a new serving certificate, signed by the CA of the given current
+// secret data, if its key is known and it is valid long enough, or by a new CA otherwise.
+// When the CA is rotated, the caBundle keeps the previous CA, as the other replicas, and the pods not bootstrapping
+// the certificates during a rollout, still serve the certificate it signed until they reload the secret or terminate.
+// The previous CA is dropped from the caBundle when the serving certificate is renewed by the new CA,
+// long after all the replicas serve the certificates signed by the new CA.
+func (b *certBootstrapper) generate(current map[string][]byte) (map[string][]byte, error) {
+
+	caCert, caKey, caPEM, caKeyPEM := b.currentCA(current)
+	bundle := caPEM
+	if caCert == nil {
+		var err error
+		if caCert, caKey, caPEM, caKeyPEM, err = b.generateCertificate(nil, nil, caValidity); err != nil {
+			return nil, fmt.Errorf("could not generate the CA: %v", err)
+		}
+		log.Printf("CA generated, valid until %s", caCert.NotAfter)
+		bundle = caPEM
+		if previous, err := parseCertificate(current[caCertSecretKey]); err == nil && previous.NotAfter.After(b.now()) {
+			log.Printf("Previous CA, valid until %s, kept in the caBundle until the serving certificate is renewed", previous.NotAfter)
+			bundle = append(append([]byte{}, caPEM...), current[caCertSecretKey]...)
+		}
+	}
+
+	_, _, certPEM, keyPEM, err := b.generateCertificate(caCert, caKey, b.validity)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate the serving certificate: %v", err)
+	}
+
+	return map[string][]byte{
+		caCertSecretKey:   caPEM,
+		caKeySecretKey:    caKeyPEM,
+		caBundleSecretKey: bundle,
+		tlsCertSecretKey:  certPEM,
+		tlsKeySecretKey:   keyPEM,
+	}, nil
+}
+
+// currentCA returns the CA of the given secret data, if its key is known and it is valid for longer than
+// the serving certificate to generate, or nil otherwise.
+func (b *certBootstrapper) currentCA(data map[string][]byte) (*x509.Certificate, crypto.Signer, []byte, []byte) {
+	caCert, err := parseCertificate(data[caCertSecretKey])
+	if err != nil {
+		return nil, nil, nil, nil
+	}
+	caKey, err := parsePrivateKey(data[caKeySecretKey])
+	if err != nil {
+		return nil, nil, nil, nil
+	}
+	if caCert.NotAfter.Before(b.now().Add(b.validity + b.renewBefore)) {
+		return nil, nil, nil, nil
+	}
+	return caCert, caKey, data[caCertSecretKey], data[caKeySecretKey]
+}
+
+// generateCertificate generates a key and a certificate valid for the given validity, signed by the given CA,
+// or a self-signed CA if the given CA is nil. The certificate and the key are returned parsed and PEM encoded.
+func (b *certBootstrapper) generateCertificate(ca *x509.Certificate, caKey crypto.Signer, validity time.Duration) (*x509.Certificate, crypto.Signer, []byte, []byte, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	now := b.now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		// Tolerate the clock skews between the webhook and the API server.
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}
+	if ca == nil {
+		template.Subject = pkix.Name{CommonName: caCommonName}
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		ca, caKey = template, key
+	} else {
+		template.Subject = pkix.Name{CommonName: b.dnsNames[0]}
+		template.DNSNames = b.dnsNames
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		if template.NotAfter.After(ca.NotAfter) {
+			template.NotAfter = ca.NotAfter
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return certificate, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		nil
+}
+
+// patchCABundles sets the caBundle of all the webhooks of the webhook configurations to the given bundle.
+// The webhook configurations which do not exist yet are patched by the next reconciliation.
+func (b *certBootstrapper) patchCABundles(ctx context.Context, caPEM []byte) error {
+
+	mutatingConfigs := b.client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	for _, name := range b.mutatingWebhooks {
+		if err := patchCABundle[*admissionregistrationv1.MutatingWebhookConfiguration](ctx, mutatingConfigs, "MutatingWebhookConfiguration", name, caPEM,
+			func(config *admissionregistrationv1.MutatingWebhookConfiguration) []*admissionregistrationv1.WebhookClientConfig {
+				clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, len(config.Webhooks))
+				for i := range config.Webhooks {
+					clientConfigs[i] = &config.Webhooks[i].ClientConfig
+				}
+				return clientConfigs
+			}); err != nil {
+			return err
+		}
+	}
+
+	validatingConfigs := b.client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	for _, name := range b.validatingWebhooks {
+		if err := patchCABundle[*admissionregistrationv1.ValidatingWebhookConfiguration](ctx, validatingConfigs, "ValidatingWebhookConfiguration", name, caPEM,
+			func(config *admissionregistrationv1.ValidatingWebhookConfiguration) []*admissionregistrationv1.WebhookClientConfig {
+				clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, len(config.Webhooks))
+				for i := range config.Webhooks {
+					clientConfigs[i] = &config.Webhooks[i].ClientConfig
+				}
+				return clientConfigs
+			}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// webhookConfigurationClient is the client of the mutating or of the validating webhook configurations.
+type webhookConfigurationClient[T any] interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (T, error)
+	Update(ctx context.Context, config T, opts metav1.UpdateOptions) (T, error)
+}
+
+// patchCABundle sets the caBundle of the given client configs of the webhooks of the webhook configuration of the
+// given kind and name to the given bundle, and updates the webhook configuration if any of them changed.
+func patchCABundle[T any](ctx context.Context, client webhookConfigurationClient[T], kind string, name string, caPEM []byte,
+	clientConfigs func(config T) []*admissionregistrationv1.WebhookClientConfig) error {
+
+	config, err := client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		log.Printf("%s %s not found, its caBundle will be patched once created", kind, name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get %s %s: %v", kind, name, err)
+	}
+	changed := false
+	for _, c := range clientConfigs(config) {
+		if !bytes.Equal(c.CABundle, caPEM) {
+			c.CABundle = caPEM
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := client.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not patch the caBundle of %s %s: %v", kind, name, err)
+	}
+	log.Printf("caBundle of %s %s patched", kind, name)
+	return nil
+}
+
+// parseCertificate parses the first certificate of the given PEM data.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parsePrivateKey parses the PEM encoded private key, either in PKCS #8, PKCS #1 or SEC 1 form,
+// such as the ones generated by openssl.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testDNSName = "k8s-mutate-image-and-policy-webhook.kube-system.svc"
+
+func newTestCertBootstrapper(now *time.Time) (*certBootstrapper, *fake.Clientset) {
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-mutate-image-and-policy-webhook"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "mutate"},
+		},
+	})
+	return &certBootstrapper{
+		client:           client,
+		secret:           types.NamespacedName{Namespace: "kube-system", Name: "tls"},
+		dnsNames:         []string{testDNSName},
+		mutatingWebhooks: []string{"k8s-mutate-image-and-policy-webhook"},
+		// Created later, patched by the next reconciliation.
+		validatingWebhooks: []string{"k8s-mutate-image-and-policy-webhook"},
+		validity:           365 * 24 * time.Hour,
+		renewBefore:        30 * 24 * time.Hour,
+		now:                func() time.Time { return *now },
+	}, client
+}
+
+func getTLSSecret(t *testing.T, client *fake.Clientset) map[string][]byte {
+	secret, err := client.CoreV1().Secrets("kube-system").Get(context.Background(), "tls", metav1.GetOptions{})
+	assert.Nil(t, err)
+	return secret.Data
+}
+
+func getCABundle(t *testing.T, client *fake.Clientset) []byte {
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "k8s-mutate-image-and-policy-webhook", metav1.GetOptions{})
+	assert.Nil(t, err)
+	return config.Webhooks[0].ClientConfig.CABundle
+}
+
+func TestCertBootstrap(t *testing.T) {
+	now := time.Now()
+	b, client := newTestCertBootstrapper(&now)
+	ctx := context.Background()
+
+	_, err := b.getCertificate(nil)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, b.reconcile(ctx))
+
+	data := getTLSSecret(t, client)
+	assert.Equal(t, data[caCertSecretKey], getCABundle(t, client))
+
+	// The served certificate is the one of the secret, valid for the service, and signed by the CA of the caBundle.
+	certificate, err := b.getCertificate(nil)
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM(getCABundle(t, client)))
+	_, err = certificate.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: testDNSName})
+	assert.Nil(t, err)
+	assert.True(t, certificate.Leaf.NotAfter.Equal(now.Add(b.validity).Truncate(time.Second)))
+
+	// Nothing changes until the certificate is about to expire.
+	now = now.Add(300 * 24 * time.Hour)
+	assert.Nil(t, b.reconcile(ctx))
+	assert.Equal(t, data, getTLSSecret(t, client))
+	served, _ := b.getCertificate(nil)
+	assert.Same(t, certificate, served)
+
+	// The webhook configurations created meanwhile are patched.
+	_, err = client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Create(ctx, &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-mutate-image-and-policy-webhook"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "validate"}, {Name: "validate-2"}},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, b.reconcile(ctx))
+	validating, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "k8s-mutate-image-and-policy-webhook", metav1.GetOptions{})
+	assert.Nil(t, err)
+	for _, w := range validating.Webhooks {
+		assert.Equal(t, data[caCertSecretKey], w.ClientConfig.CABundle)
+	}
+}
+
+func TestCertBootstrapRenewal(t *testing.T) {
+	now := time.Now()
+	b, client := newTestCertBootstrapper(&now)
+	ctx := context.Background()
+
+	assert.Nil(t, b.reconcile(ctx))
+	initial := getTLSSecret(t, client)
+	certificate, _ := b.getCertificate(nil)
+
+	// The serving certificate is renewed before it expires, signed by the same CA.
+	now = now.Add(340 * 24 * time.Hour)
+	assert.Nil(t, b.reconcile(ctx))
+	renewed := getTLSSecret(t, client)
+	assert.NotEqual(t, initial[tlsCertSecretKey], renewed[tlsCertSecretKey])
+	assert.Equal(t, initial[caCertSecretKey], renewed[caCertSecretKey])
+	served, _ := b.getCertificate(nil)
+	assert.NotSame(t, certificate, served)
+	assert.True(t, served.Leaf.NotAfter.After(now.Add(300*24*time.Hour)))
+
+	// The CA is renewed when it would expire before the serving certificate, the previous one being kept in the caBundle.
+	now = now.Add(caValidity - 540*24*time.Hour)
+	assert.Nil(t, b.reconcile(ctx))
+	renewed = getTLSSecret(t, client)
+	assert.NotEqual(t, initial[caCertSecretKey], renewed[caCertSecretKey])
+	assert.Equal(t, append(append([]byte{}, renewed[caCertSecretKey]...), initial[caCertSecretKey]...), getCABundle(t, client))
+}
+
+// verifies returns whether the given PEM encoded certificate is trusted by the given caBundle at the given time.
+func verifies(t *testing.T, certPEM []byte, bundle []byte, now time.Time) bool {
+	certificate, err := parseCertificate(certPEM)
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM(bundle))
+	_, err = certificate.Verify(x509.VerifyOptions{Roots: roots, DNSName: testDNSName, CurrentTime: now})
+	return err == nil
+}
+
+func TestCertBootstrapCARotation(t *testing.T) {
+	now := time.Now()
+	b, client := newTestCertBootstrapper(&now)
+	ctx := context.Background()
+
+	// A secret generated by generate-certs-and-config.sh, without the key of the CA, mounted by the pods being replaced.
+	generated, err := b.generate(nil)
+	assert.Nil(t, err)
+	delete(generated, caKeySecretKey)
+	delete(generated, caBundleSecretKey)
+	_, err = client.CoreV1().Secrets("kube-system").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "tls"},
+		Data:       generated,
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	other, _ := newTestCertBootstrapper(&now)
+	other.client = client
+	assert.Nil(t, other.reconcile(ctx))
+
+	// Expiring, the certificates are generated with a new CA, as its key is not known.
+	now = now.Add(340 * 24 * time.Hour)
+	assert.Nil(t, b.reconcile(ctx))
+	rotated := getTLSSecret(t, client)
+	assert.NotEqual(t, generated[caCertSecretKey], rotated[caCertSecretKey])
+
+	// Both the certificate served by the other replica, not reloaded yet, and the new one are trusted.
+	bundle := getCABundle(t, client)
+	served, _ := other.getCertificate(nil)
+	assert.Equal(t, generated[tlsCertSecretKey], pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: served.Certificate[0]}))
+	assert.True(t, verifies(t, generated[tlsCertSecretKey], bundle, now))
+	assert.True(t, verifies(t, rotated[tlsCertSecretKey], bundle, now))
+
+	// The other replica reloads the secret, and keeps the caBundle.
+	assert.Nil(t, other.reconcile(ctx))
+	assert.Equal(t, bundle, getCABundle(t, client))
+
+	// The previous CA is dropped once the serving certificate is renewed by the new CA.
+	now = now.Add(340 * 24 * time.Hour)
+	assert.Nil(t, b.reconcile(ctx))
+	renewed := getTLSSecret(t, client)
+	assert.Equal(t, rotated[caCertSecretKey], renewed[caCertSecretKey])
+	assert.Equal(t, renewed[caCertSecretKey], getCABundle(t, client))
+	assert.True(t, verifies(t, renewed[tlsCertSecretKey], getCABundle(t, client), now))
+}
+
+func TestCertBootstrapRenewedByAnotherReplica(t *testing.T) {
+	now := time.Now()
+	b, client := newTestCertBootstrapper(&now)
+	other, _ := newTestCertBootstrapper(&now)
+	other.client = client
+	ctx := context.Background()
+
+	assert.Nil(t, b.reconcile(ctx))
+	assert.Nil(t, other.reconcile(ctx))
+
+	// Both replicas serve the same certificate.
+	c1, _ := b.getCertificate(nil)
+	c2, _ := other.getCertificate(nil)
+	assert.Equal(t, c1.Certificate, c2.Certificate)
+}
+
+func TestCertBootstrapExistingSecret(t *testing.T) {
+	now := time.Now()
+	b, client := newTestCertBootstrapper(&now)
+	ctx := context.Background()
+
+	// A secret generated by generate-certs-and-config.sh, without the key of the CA, is used as is while valid.
+	generated, err := b.generate(nil)
+	assert.Nil(t, err)
+	delete(generated, caKeySecretKey)
+	_, err = client.CoreV1().Secrets("kube-system").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "tls"},
+		Data:       generated,
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, b.reconcile(ctx))
+	assert.Equal(t, generated, getTLSSecret(t, client))
+
+	// Not valid for the DNS names anymore, the certificates are generated with a new CA.
+	b.dnsNames = []string{"k8s-mutate-image-and-policy-webhook.webhooks.svc"}
+	assert.Nil(t, b.reconcile(ctx))
+	data := getTLSSecret(t, client)
+	assert.NotEqual(t, generated[caCertSecretKey], data[caCertSecretKey])
+	assert.NotEmpty(t, data[caKeySecretKey])
+	certificate, err := tls.X509KeyPair(data[tlsCertSecretKey], data[tlsKeySecretKey])
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k8s-mutate-image-and-policy-webhook.webhooks.svc"}, leaf.DNSNames)
+}
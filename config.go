@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// cacheSyncTimeout is how long a reload waits for the cache of the objects the webhook looks up to be synced,
+// such that a reload enabling a rule the webhook is not allowed to watch the objects of fails instead of hanging.
+var cacheSyncTimeout = 10 * time.Second
+
+// webhookConfig holds all the rules of the webhook. They are read from the environment variables,
+// and optionally overridden by the configuration file, in YAML or JSON, using the json names.
+type webhookConfig struct {
+	Registry                    string          `envconfig:"REGISTRY" json:"registry"`
+	RegistryMapping             stringMap       `envconfig:"REGISTRY_MAPPING" json:"registryMapping"`
+	ImagePullSecret             string          `envconfig:"IMAGE_PULL_SECRET" json:"imagePullSecret"`
+	AppendImagePullSecret       bool            `envconfig:"IMAGE_PULL_SECRET_APPEND" default:"false" json:"appendImagePullSecret"`
+	ForceImagePullPolicy        bool            `envconfig:"FORCE_IMAGE_PULL_POLICY" json:"forceImagePullPolicy"`
+	ImagePullPolicyToForce      string          `envconfig:"IMAGE_PULL_POLICY_TO_FORCE" default:"Always" json:"imagePullPolicyToForce"`
+	DefaultStorageClass         string          `envconfig:"DEFAULT_STORAGE_CLASS" json:"defaultStorageClass"`
+	StorageClassPolicy          string          `envconfig:"STORAGE_CLASS_POLICY" default:"Force" json:"storageClassPolicy"`
+	StorageClassMapping         stringMap       `envconfig:"STORAGE_CLASS_MAPPING" json:"storageClassMapping"`
+	ExcludeNamespaces           []string        `envconfig:"EXCLUDE_NAMESPACES" json:"excludeNamespaces"`
+	ExcludeNamespaceSelector    string          `envconfig:"EXCLUDE_NAMESPACE_SELECTOR" json:"excludeNamespaceSelector"`
+	IgnoredRegistries           []string        `envconfig:"IGNORED_REGISTRIES" json:"ignoredRegistries"`
+	MutateWorkloads             bool            `envconfig:"MUTATE_WORKLOADS" default:"false" json:"mutateWorkloads"`
+	AllowedRegistries           []string        `envconfig:"ALLOWED_REGISTRIES" json:"allowedRegistries"`
+	ValidationExcludeNamespaces []string        `envconfig:"VALIDATION_EXCLUDE_NAMESPACES" json:"validationExcludeNamespaces"`
+	OptIn                       bool            `envconfig:"OPT_IN" default:"false" json:"optIn"`
+	OptOutNamespaces            []string        `envconfig:"OPT_OUT_NAMESPACES" json:"optOutNamespaces"`
+	RecordOriginal              bool            `envconfig:"RECORD_ORIGINAL" default:"false" json:"recordOriginal"`
+	PinDigests                  bool            `envconfig:"PIN_DIGESTS" default:"false" json:"pinDigests"`
+	DigestResolveTimeout        duration        `envconfig:"DIGEST_RESOLVE_TIMEOUT" default:"5s" json:"digestResolveTimeout"`
+	DigestCacheTTL              duration        `envconfig:"DIGEST_CACHE_TTL" default:"5m" json:"digestCacheTTL"`
+	DigestFailurePolicy         string          `envconfig:"DIGEST_FAILURE_POLICY" default:"Ignore" json:"digestFailurePolicy"`
+	LatestTagPolicy             string          `envconfig:"LATEST_TAG_POLICY" default:"Allow" json:"latestTagPolicy"`
+	DefaultTag                  string          `envconfig:"DEFAULT_TAG" json:"defaultTag"`
+	LatestTagAllowedNamespaces  []string        `envconfig:"LATEST_TAG_ALLOWED_NAMESPACES" json:"latestTagAllowedNamespaces"`
+	PullPolicyRules             pullPolicyRules `envconfig:"PULL_POLICY_RULES" json:"pullPolicyRules"`
+	RegistryPullSecrets         stringMap       `envconfig:"REGISTRY_PULL_SECRETS" json:"registryPullSecrets"`
+	MissingPullSecretPolicy     string          `envconfig:"MISSING_PULL_SECRET_POLICY" default:"Inject" json:"missingPullSecretPolicy"`
+	PullSecretTarget            string          `envconfig:"PULL_SECRET_TARGET" default:"Pod" json:"pullSecretTarget"`
+	MutationWarnings            bool            `envconfig:"MUTATION_WARNINGS" json:"mutationWarnings"`
+}
+
+// stringMap is a map decoded by envconfig from a comma separated list of key=value pairs,
+// such as "docker.io=harbor.corp/dockerhub,quay.io=harbor.corp/quay".
+// The = separator allows keys to contain a port, such as "localhost:5000=harbor.corp/local".
+type stringMap map[string]string
+
+// Decode implements the envconfig.Decoder interface.
+func (m *stringMap) Decode(value string) error {
+	decoded := stringMap{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return fmt.Errorf("invalid mapping entry %q, expected key=value", pair)
+		}
+		decoded[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	*m = decoded
+	return nil
+}
+
+// copy returns a copy of the map, such that decoding a configuration file into it
+// does not alter the map of the environment variables.
+func (m stringMap) copy() stringMap {
+	if m == nil {
+		return nil
+	}
+	copied := make(stringMap, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// duration is a time.Duration decoded from a string such as 5s, by envconfig as well as from the configuration file.
+type duration time.Duration
+
+// Decode implements the envconfig.Decoder interface.
+func (d *duration) Decode(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as 5s", data)
+	}
+	return d.Decode(value)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// parseConfig overrides the given defaults with the content of a configuration file.
+// Fields missing from the file keep their default value, and the mappings are merged
+// with the default ones. Unknown fields are rejected to catch typos.
+func parseConfig(defaults webhookConfig, content []byte) (webhookConfig, error) {
+	// Decoding reuses the maps and the arrays of the slices, copy them
+	// such that the defaults are not altered.
+	cfg := defaults
+	cfg.RegistryMapping = defaults.RegistryMapping.copy()
+	cfg.StorageClassMapping = defaults.StorageClassMapping.copy()
+	cfg.RegistryPullSecrets = defaults.RegistryPullSecrets.copy()
+	cfg.ExcludeNamespaces = append([]string(nil), defaults.ExcludeNamespaces...)
+	cfg.IgnoredRegistries = append([]string(nil), defaults.IgnoredRegistries...)
+	cfg.AllowedRegistries = append([]string(nil), defaults.AllowedRegistries...)
+	cfg.ValidationExcludeNamespaces = append([]string(nil), defaults.ValidationExcludeNamespaces...)
+	cfg.OptOutNamespaces = append([]string(nil), defaults.OptOutNamespaces...)
+	cfg.LatestTagAllowedNamespaces = append([]string(nil), defaults.LatestTagAllowedNamespaces...)
+	cfg.PullPolicyRules = append(pullPolicyRules(nil), defaults.PullPolicyRules...)
+
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return webhookConfig{}, fmt.Errorf("could not parse configuration: %v", err)
+	}
+	return cfg, nil
+}
+
+// newMutationWH validates the configuration and returns the corresponding mutationWH.
+func newMutationWH(cfg webhookConfig) (*mutationWH, error) {
+
+	// Validate pull policy
+	pullPolicyValid, pullPolicyToForce := isPullPolicyValid(cfg.ImagePullPolicyToForce)
+	if !pullPolicyValid {
+		return nil, fmt.Errorf("pull policy %s is not valid, fix IMAGE_PULL_POLICY_TO_FORCE and retry", cfg.ImagePullPolicyToForce)
+	}
+
+	if err := cfg.PullPolicyRules.validate(); err != nil {
+		return nil, fmt.Errorf("%v, fix PULL_POLICY_RULES and retry", err)
+	}
+
+	// Validate storage class policy
+	storageClassPolicyValid, storageClassPolicy := isStorageClassPolicyValid(cfg.StorageClassPolicy)
+	if !storageClassPolicyValid {
+		return nil, fmt.Errorf("storage class policy %s is not valid, fix STORAGE_CLASS_POLICY and retry", cfg.StorageClassPolicy)
+	}
+	if storageClassPolicy == storageClassTranslate && len(cfg.StorageClassMapping) == 0 {
+		return nil, fmt.Errorf("storage class policy %s requires a mapping, fix STORAGE_CLASS_MAPPING and retry", cfg.StorageClassPolicy)
+	}
+
+	// Validate latest tag policy
+	latestTagPolicyValid, latestTagPolicy := isLatestTagPolicyValid(cfg.LatestTagPolicy)
+	if !latestTagPolicyValid {
+		return nil, fmt.Errorf("latest tag policy %s is not valid, fix LATEST_TAG_POLICY and retry", cfg.LatestTagPolicy)
+	}
+	if latestTagPolicy == latestTagRewrite && (cfg.DefaultTag == "" || cfg.DefaultTag == latestTag) {
+		return nil, fmt.Errorf("latest tag policy %s requires a default tag other than %s, fix DEFAULT_TAG and retry", cfg.LatestTagPolicy, latestTag)
+	}
+	if latestTagPolicy == latestTagRewrite && !isTagValid(cfg.DefaultTag) {
+		return nil, fmt.Errorf("default tag %s is not a valid tag, fix DEFAULT_TAG and retry", cfg.DefaultTag)
+	}
+
+	// Compile namespace patterns and validate selector
+	if err := compileNamespacePatterns(cfg.ExcludeNamespaces); err != nil {
+		return nil, fmt.Errorf("%v, fix EXCLUDE_NAMESPACES and retry", err)
+	}
+	if err := compileNamespacePatterns(cfg.ValidationExcludeNamespaces); err != nil {
+		return nil, fmt.Errorf("%v, fix VALIDATION_EXCLUDE_NAMESPACES and retry", err)
+	}
+	if err := compileNamespacePatterns(cfg.OptOutNamespaces); err != nil {
+		return nil, fmt.Errorf("%v, fix OPT_OUT_NAMESPACES and retry", err)
+	}
+	if err := compileNamespacePatterns(cfg.LatestTagAllowedNamespaces); err != nil {
+		return nil, fmt.Errorf("%v, fix LATEST_TAG_ALLOWED_NAMESPACES and retry", err)
+	}
+	// Validate digest pinning
+	digestFailurePolicyValid, digestFailurePolicy := isDigestFailurePolicyValid(cfg.DigestFailurePolicy)
+	if !digestFailurePolicyValid {
+		return nil, fmt.Errorf("digest failure policy %s is not valid, fix DIGEST_FAILURE_POLICY and retry", cfg.DigestFailurePolicy)
+	}
+	var resolver *digestResolver
+	if cfg.PinDigests {
+		timeout := time.Duration(cfg.DigestResolveTimeout)
+		resolver = newDigestResolver(&http.Client{Timeout: timeout}, timeout, time.Duration(cfg.DigestCacheTTL))
+	}
+
+	missingPullSecretPolicyValid, missingPullSecretPolicy := isMissingPullSecretPolicyValid(cfg.MissingPullSecretPolicy)
+	if !missingPullSecretPolicyValid {
+		return nil, fmt.Errorf("missing pull secret policy %s is not valid, fix MISSING_PULL_SECRET_POLICY and retry", cfg.MissingPullSecretPolicy)
+	}
+
+	pullSecretTargetValid, pullSecretTarget := isPullSecretTargetValid(cfg.PullSecretTarget)
+	if !pullSecretTargetValid {
+		return nil, fmt.Errorf("pull secret target %s is not valid, fix PULL_SECRET_TARGET and retry", cfg.PullSecretTarget)
+	}
+
+	excludedNamespaceSelector, err := parseNamespaceSelector(cfg.ExcludeNamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("%v, fix EXCLUDE_NAMESPACE_SELECTOR and retry", err)
+	}
+
+	return &mutationWH{
+		registry:                     cfg.Registry,
+		registryMapping:              cfg.RegistryMapping,
+		imagePullSecret:              cfg.ImagePullSecret,
+		appendImagePullSecret:        cfg.AppendImagePullSecret,
+		forceImagePullPolicy:         cfg.ForceImagePullPolicy,
+		imagePullPolicyToForce:       pullPolicyToForce,
+		defaultStorageClass:          cfg.DefaultStorageClass,
+		storageClassPolicy:           storageClassPolicy,
+		storageClassMapping:          cfg.StorageClassMapping,
+		excludedNamespaces:           cfg.ExcludeNamespaces,
+		excludedNamespaceSelector:    excludedNamespaceSelector,
+		ignoredRegistries:            cfg.IgnoredRegistries,
+		mutateWorkloads:              cfg.MutateWorkloads,
+		allowedRegistries:            cfg.AllowedRegistries,
+		validationExcludedNamespaces: cfg.ValidationExcludeNamespaces,
+		optIn:                        cfg.OptIn,
+		optOutNamespaces:             cfg.OptOutNamespaces,
+		recordOriginal:               cfg.RecordOriginal,
+		digestResolver:               resolver,
+		digestFailurePolicy:          digestFailurePolicy,
+		latestTagPolicy:              latestTagPolicy,
+		defaultTag:                   cfg.DefaultTag,
+		latestTagAllowedNamespaces:   cfg.LatestTagAllowedNamespaces,
+		pullPolicyRules:              cfg.PullPolicyRules,
+		registryPullSecrets:          cfg.RegistryPullSecrets,
+		missingPullSecretPolicy:      missingPullSecretPolicy,
+		pullSecretTarget:             pullSecretTarget,
+		mutationWarnings:             cfg.MutationWarnings,
+	}, nil
+}
+
+// webhookServer serves the admission requests with the current mutationWH, which is atomically
+// swapped when the configuration file changes. Each request is served by the mutationWH
+// loaded when it starts, hence in-flight requests are not affected by a reload.
+type webhookServer struct {
+	defaults   webhookConfig
+	configFile string
+
+	// kubeClient is used to watch the objects the webhook looks up, such as namespaces, and metadataClient
+	// to watch the ones whose metadata is enough, such as secrets, which data is not kept in memory.
+	// They are nil when the webhook is not running in a cluster.
+	kubeClient       kubernetes.Interface
+	metadataClient   metadata.Interface
+	namespacesOnce   sync.Once
+	namespaces       listersv1.NamespaceLister
+	namespacesSynced cache.InformerSynced
+	secretsOnce      sync.Once
+	secrets          cache.GenericLister
+	secretsSynced    cache.InformerSynced
+
+	current atomic.Pointer[mutationWH]
+
+	// reloadMutex prevents concurrent reloads, and protects the content of the last loaded file.
+	reloadMutex sync.Mutex
+	lastContent []byte
+
+	// reloadErrorMutex protects the error of the last reload, which is kept apart from reloadMutex
+	// such that the readiness is not blocked by a reload waiting for a cache to sync.
+	reloadErrorMutex sync.Mutex
+	reloadError      error
+}
+
+// newWebhookServer returns a webhookServer using the given defaults, overridden by the
+// configuration file, if any. The configuration is loaded once, an error is returned if it is not valid.
+// The kube clients are optional, but required by the rules looking up objects from the API server.
+func newWebhookServer(defaults webhookConfig, configFile string, kubeClient kubernetes.Interface, metadataClient metadata.Interface) (*webhookServer, error) {
+	s := &webhookServer{
+		defaults:       defaults,
+		configFile:     configFile,
+		kubeClient:     kubeClient,
+		metadataClient: metadataClient,
+	}
+	if _, err := s.reloadConfig(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reloadConfig reads the configuration file, if any, and swaps the current mutationWH if the content
+// of the file changed since the last reload. It returns whether the mutationWH has been swapped.
+// If the configuration is not valid, an error is returned and the current mutationWH is kept,
+// and the webhook is not ready until a valid configuration is reloaded, see configReady.
+func (s *webhookServer) reloadConfig() (reloaded bool, err error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	defer func() {
+		s.reloadErrorMutex.Lock()
+		s.reloadError = err
+		s.reloadErrorMutex.Unlock()
+	}()
+
+	cfg := s.defaults
+	var content []byte
+	if s.configFile != "" {
+		if content, err = os.ReadFile(s.configFile); err != nil {
+			return false, fmt.Errorf("could not read configuration file %s: %v", s.configFile, err)
+		}
+		if s.current.Load() != nil && bytes.Equal(content, s.lastContent) {
+			return false, nil
+		}
+		if cfg, err = parseConfig(s.defaults, content); err != nil {
+			return false, fmt.Errorf("configuration file %s: %v", s.configFile, err)
+		}
+	}
+
+	wh, err := newMutationWH(cfg)
+	if err != nil {
+		return false, err
+	}
+	if wh.excludedNamespaceSelector != nil {
+		if wh.namespaces, err = s.namespaceLister(); err != nil {
+			return false, fmt.Errorf("namespace selector %s: %v", cfg.ExcludeNamespaceSelector, err)
+		}
+	}
+	if wh.missingPullSecretPolicy != missingPullSecretInject {
+		if wh.secrets, err = s.secretLister(); err != nil {
+			return false, fmt.Errorf("missing pull secret policy %s: %v", cfg.MissingPullSecretPolicy, err)
+		}
+	}
+
+	s.current.Store(wh)
+	s.lastContent = content
+	return true, nil
+}
+
+// configReady returns an error while the last reload of the configuration failed, hence while the webhook
+// does not serve the current configuration file.
+func (s *webhookServer) configReady() error {
+	s.reloadErrorMutex.Lock()
+	defer s.reloadErrorMutex.Unlock()
+
+	if s.current.Load() == nil {
+		return notLoaded("configuration")()
+	}
+	if s.reloadError != nil {
+		return fmt.Errorf("the configuration could not be reloaded: %v", s.reloadError)
+	}
+	return nil
+}
+
+// pollEvery calls fn every interval, until the stop channel is closed. The files mounted from ConfigMap
+// and Secret volumes, such as the configuration file and the certificates, are polled this way and reloaded
+// when their content changes: the volumes are updated by swapping symlinks, which is why the content is
+// compared instead of relying on file system events.
+func pollEvery(interval time.Duration, stop <-chan struct{}, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// watchConfigFile polls the configuration file every interval, and reloads it when its content changes,
+// until the stop channel is closed.
+func (s *webhookServer) watchConfigFile(interval time.Duration, stop <-chan struct{}) {
+	pollEvery(interval, stop, func() {
+		if reloaded, err := s.reloadConfig(); err != nil {
+			log.Errorf("Could not reload the configuration, keeping the previous one: %v", err)
+		} else if reloaded {
+			log.Printf("Configuration reloaded from %s", s.configFile)
+		}
+	})
+}
+
+// namespaceLister returns the lister of the namespace cache, starting to watch the namespaces on first call.
+// An error is returned if the cache is not synced within cacheSyncTimeout, such as when the webhook is not allowed
+// to watch the namespaces, in which case the next call waits for it again.
+func (s *webhookServer) namespaceLister() (listersv1.NamespaceLister, error) {
+	if s.kubeClient == nil {
+		return nil, errors.New("the namespaces cannot be looked up when not running in a cluster")
+	}
+	s.namespacesOnce.Do(func() {
+		factory := informers.NewSharedInformerFactory(s.kubeClient, 0)
+		informer := factory.Core().V1().Namespaces()
+		s.namespaces, s.namespacesSynced = informer.Lister(), informer.Informer().HasSynced
+		factory.Start(nil)
+	})
+	if err := waitForCacheSync("namespaces", s.namespacesSynced); err != nil {
+		return nil, err
+	}
+	return s.namespaces, nil
+}
+
+// secretLister returns the lister of the secret metadata cache, starting to watch the secrets on first call.
+// Only the metadata of the secrets is cached, as their existence is all the webhook needs.
+// An error is returned if the cache is not synced within cacheSyncTimeout, such as when the webhook is not allowed
+// to watch the secrets, in which case the next call waits for it again.
+func (s *webhookServer) secretLister() (cache.GenericLister, error) {
+	if s.metadataClient == nil {
+		return nil, errors.New("the secrets cannot be looked up when not running in a cluster")
+	}
+	s.secretsOnce.Do(func() {
+		factory := metadatainformer.NewSharedInformerFactory(s.metadataClient, 0)
+		informer := factory.ForResource(corev1.SchemeGroupVersion.WithResource("secrets"))
+		s.secrets, s.secretsSynced = informer.Lister(), informer.Informer().HasSynced
+		factory.Start(nil)
+	})
+	if err := waitForCacheSync("secrets", s.secretsSynced); err != nil {
+		return nil, err
+	}
+	return s.secrets, nil
+}
+
+// waitForCacheSync waits for the cache of the given objects to be synced, for up to cacheSyncTimeout.
+// The informer keeps retrying in the background when it times out.
+func waitForCacheSync(objects string, synced cache.InformerSynced) error {
+	if synced() {
+		return nil
+	}
+	stop := make(chan struct{})
+	timer := time.AfterFunc(cacheSyncTimeout, func() { close(stop) })
+	defer timer.Stop()
+	if !cache.WaitForCacheSync(stop, synced) {
+		return fmt.Errorf("the %s could not be watched within %s, check the RBAC rules of the webhook", objects, cacheSyncTimeout)
+	}
+	log.Printf("The %s are watched and cached", objects)
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestStringMapDecode(t *testing.T) {
+	var m stringMap
+	assert.Nil(t, m.Decode("docker.io=harbor.corp/dockerhub, quay.io=harbor.corp/quay,localhost:5000=harbor.corp/local"))
+	assert.Equal(t, stringMap{
+		"docker.io":      "harbor.corp/dockerhub",
+		"quay.io":        "harbor.corp/quay",
+		"localhost:5000": "harbor.corp/local",
+	}, m)
+
+	assert.Nil(t, m.Decode(""))
+	assert.Equal(t, 0, len(m))
+
+	assert.NotNil(t, m.Decode("docker.io"))
+	assert.NotNil(t, m.Decode("=harbor.corp/dockerhub"))
+	assert.NotNil(t, m.Decode("docker.io="))
+}
+
+func TestParseConfigYAML(t *testing.T) {
+	defaults := webhookConfig{
+		Registry:               "x.y",
+		RegistryMapping:        stringMap{"quay.io": "x.y/quay"},
+		ImagePullPolicyToForce: "Always",
+		ExcludeNamespaces:      []string{"kube-system"},
+	}
+
+	cfg, err := parseConfig(defaults, []byte(`
+registryMapping:
+  docker.io: x.y/dockerhub
+excludeNamespaces:
+  - kube-public
+forceImagePullPolicy: true
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "x.y", cfg.Registry)
+	assert.Equal(t, stringMap{"quay.io": "x.y/quay", "docker.io": "x.y/dockerhub"}, cfg.RegistryMapping)
+	assert.Equal(t, []string{"kube-public"}, cfg.ExcludeNamespaces)
+	assert.True(t, cfg.ForceImagePullPolicy)
+	assert.Equal(t, "Always", cfg.ImagePullPolicyToForce)
+
+	// The defaults are not altered by the configuration file.
+	assert.Equal(t, stringMap{"quay.io": "x.y/quay"}, defaults.RegistryMapping)
+	assert.Equal(t, []string{"kube-system"}, defaults.ExcludeNamespaces)
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	cfg, err := parseConfig(webhookConfig{}, []byte(`{"registry": "x.y", "ignoredRegistries": ["a.b"]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "x.y", cfg.Registry)
+	assert.Equal(t, []string{"a.b"}, cfg.IgnoredRegistries)
+}
+
+func TestParseConfigUnknownField(t *testing.T) {
+	_, err := parseConfig(webhookConfig{}, []byte(`registy: x.y`))
+	assert.NotNil(t, err)
+}
+
+func TestNewMutationWHInvalid(t *testing.T) {
+	_, err := newMutationWH(webhookConfig{ImagePullPolicyToForce: "Sometimes"})
+	assert.NotNil(t, err)
+
+	_, err = newMutationWH(webhookConfig{ImagePullPolicyToForce: "Always", StorageClassPolicy: "Translate"})
+	assert.NotNil(t, err)
+
+	wh, err := newMutationWH(webhookConfig{ImagePullPolicyToForce: "Never", StorageClassPolicy: "IfMissing"})
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.PullNever, wh.imagePullPolicyToForce)
+	assert.Equal(t, storageClassIfMissing, wh.storageClassPolicy)
+}
+
+func TestWebhookServerReloadConfig(t *testing.T) {
+	defaults := webhookConfig{
+		Registry:               "x.y",
+		ImagePullPolicyToForce: "Always",
+	}
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(configFile, []byte(`excludeNamespaces: ["kube-system"]`), 0600))
+
+	s, err := newWebhookServer(defaults, configFile, nil, nil)
+	assert.Nil(t, err)
+	initial := s.current.Load()
+	assert.Equal(t, "x.y", initial.registry)
+	assert.Equal(t, []string{"kube-system"}, initial.excludedNamespaces)
+
+	// Unchanged content does not swap the mutationWH.
+	reloaded, err := s.reloadConfig()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+	assert.Same(t, initial, s.current.Load())
+
+	// An invalid configuration keeps the current mutationWH.
+	assert.Nil(t, os.WriteFile(configFile, []byte(`imagePullPolicyToForce: Sometimes`), 0600))
+	reloaded, err = s.reloadConfig()
+	assert.NotNil(t, err)
+	assert.False(t, reloaded)
+	assert.Same(t, initial, s.current.Load())
+
+	assert.Nil(t, os.WriteFile(configFile, []byte(`registry: a.b`), 0600))
+	reloaded, err = s.reloadConfig()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "a.b", s.current.Load().registry)
+	assert.Nil(t, s.current.Load().excludedNamespaces)
+	// The mutationWH serving in-flight requests is left untouched.
+	assert.Equal(t, "x.y", initial.registry)
+}
+
+func TestWebhookServerWithoutConfigFile(t *testing.T) {
+	_, err := newWebhookServer(webhookConfig{ImagePullPolicyToForce: "Sometimes"}, "", nil, nil)
+	assert.NotNil(t, err)
+
+	s, err := newWebhookServer(webhookConfig{Registry: "x.y", ImagePullPolicyToForce: "Always"}, "", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "x.y", s.current.Load().registry)
+}
+
+func TestWebhookServerSecretLister(t *testing.T) {
+	metadataScheme := metadatafake.NewTestScheme()
+	assert.Nil(t, metav1.AddMetaToScheme(metadataScheme))
+	metadataClient := metadatafake.NewSimpleMetadataClient(metadataScheme, &metav1.PartialObjectMetadata{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "harbor"},
+	})
+
+	s, err := newWebhookServer(webhookConfig{
+		ImagePullPolicyToForce:  "Always",
+		MissingPullSecretPolicy: "Warn",
+	}, "", nil, metadataClient)
+	assert.Nil(t, err)
+	_, err = s.current.Load().secrets.ByNamespace("ns").Get("harbor")
+	assert.Nil(t, err)
+	_, err = s.current.Load().secrets.ByNamespace("ns").Get("quay")
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestWebhookServerCacheSyncTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { cacheSyncTimeout = timeout }(cacheSyncTimeout)
+	cacheSyncTimeout = 100 * time.Millisecond
+
+	// Not allowed to watch the namespaces, such as when the RBAC rule is missing.
+	kubeClient := fake.NewSimpleClientset()
+	kubeClient.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("namespaces"), "", errors.New("not allowed"))
+	})
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(configFile, []byte(`registry: x.y`), 0600))
+	s, err := newWebhookServer(webhookConfig{ImagePullPolicyToForce: "Always"}, configFile, kubeClient, nil)
+	assert.Nil(t, err)
+
+	// The reload enabling the namespace selector fails instead of hanging, and the webhook is not ready.
+	assert.Nil(t, os.WriteFile(configFile, []byte(`excludeNamespaceSelector: team=infra`), 0600))
+	_, err = s.reloadConfig()
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.configReady())
+	assert.Equal(t, "x.y", s.current.Load().registry)
+
+	// Fails again on the next reload, as long as the namespaces cannot be watched.
+	_, err = s.reloadConfig()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	simplejson "encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// dockerHubAPIHost is the host serving the registry API of docker hub, i.e. of the docker.io images.
+	dockerHubAPIHost = "registry-1.docker.io"
+)
+
+// manifestMediaTypes are the media types of the manifests accepted when resolving a tag, multi-platform ones first,
+// such that the digest of an image is the same as the one of the image pulled by the container runtime.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// digestFailurePolicy tells what to do with an image whose digest cannot be resolved.
+type digestFailurePolicy string
+
+const (
+	// digestFailureIgnore keeps the image unpinned, the default policy.
+	digestFailureIgnore digestFailurePolicy = "Ignore"
+	// digestFailureFail denies the request.
+	digestFailureFail digestFailurePolicy = "Fail"
+)
+
+func isDigestFailurePolicyValid(policy string) (bool, digestFailurePolicy) {
+	switch digestFailurePolicy(policy) {
+	case "":
+		return true, digestFailureIgnore
+	case digestFailureIgnore, digestFailureFail:
+		return true, digestFailurePolicy(policy)
+	default:
+		return false, digestFailureIgnore
+	}
+}
+
+// digestResolver resolves the tags of the images to their digests, via the OCI distribution API
+// of the registries, caching the resolutions for the given TTL. The resolutions of all the images
+// of an admission request share the timeout, see requestContext.
+type digestResolver struct {
+	client  *http.Client
+	timeout time.Duration
+	ttl     time.Duration
+	now     func() time.Time
+
+	mutex sync.Mutex
+	cache map[string]resolvedDigest
+}
+
+// resolvedDigest is a digest of the cache, resolved at the given time.
+type resolvedDigest struct {
+	digest     digest.Digest
+	resolvedAt time.Time
+}
+
+// newDigestResolver returns a digestResolver using the given HTTP client, timing out the resolutions of the images
+// of an admission request after the given timeout, and caching the resolutions for the given TTL.
+func newDigestResolver(client *http.Client, timeout time.Duration, ttl time.Duration) *digestResolver {
+	return &digestResolver{
+		client:  client,
+		timeout: timeout,
+		ttl:     ttl,
+		now:     time.Now,
+		cache:   map[string]resolvedDigest{},
+	}
+}
+
+// requestContext returns the context of the resolutions of the images of an admission request, which times out
+// after the timeout, whatever the number of images, such that the admission request itself does not time out
+// when the registries are unreachable, and the digest failure policy applies.
+func (r *digestResolver) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+// pinImage returns the image with the digest its tag resolves to appended, such as a.b/c:v@sha256:...
+// The tag is kept for readability, and images already referenced by digest are returned as is.
+// The resolution is canceled when the given context is done.
+func (r *digestResolver) pinImage(ctx context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image, fmt.Errorf("image %s is not a valid reference: %v", image, err)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return image, nil
+	}
+
+	d, err := r.resolve(ctx, reference.TagNameOnly(named).(reference.NamedTagged))
+	if err != nil {
+		return image, err
+	}
+	return image + "@" + d.String(), nil
+}
+
+// resolve returns the digest the given tagged image resolves to, from the cache if not expired,
+// or from the registry otherwise, until the given context is done.
+func (r *digestResolver) resolve(ctx context.Context, named reference.NamedTagged) (digest.Digest, error) {
+	key := named.String()
+
+	r.mutex.Lock()
+	cached, ok := r.cache[key]
+	r.mutex.Unlock()
+	if ok && r.now().Sub(cached.resolvedAt) < r.ttl {
+		log.Tracef("Digest of %s found in cache: %s", key, cached.digest)
+		return cached.digest, nil
+	}
+
+	d, err := r.fetchDigest(ctx, named)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve the digest of %s: %v", key, err)
+	}
+	log.Debugf("Digest of %s resolved: %s", key, d)
+
+	r.mutex.Lock()
+	r.store(key, d)
+	r.mutex.Unlock()
+	return d, nil
+}
+
+// store caches the given digest of the given image, and evicts the expired ones, such that the cache does not
+// grow with every tag ever resolved. It must be called with the mutex held.
+func (r *digestResolver) store(key string, d digest.Digest) {
+	now := r.now()
+	for k, cached := range r.cache {
+		if now.Sub(cached.resolvedAt) >= r.ttl {
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = resolvedDigest{digest: d, resolvedAt: now}
+}
+
+// fetchDigest requests the manifest of the given tagged image to its registry, and returns its digest, found in the
+// Docker-Content-Digest header. Registries requiring a token, such as docker hub, are authenticated anonymously.
+func (r *digestResolver) fetchDigest(ctx context.Context, named reference.NamedTagged) (digest.Digest, error) {
+	host := reference.Domain(named)
+	if host == dockerHubRegistry {
+		host = dockerHubAPIHost
+	}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, reference.Path(named), named.Tag())
+
+	resp, err := r.headManifest(ctx, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := r.fetchToken(ctx, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		if resp, err = r.headManifest(ctx, manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry answered %s", resp.Status)
+	}
+
+	d, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return "", fmt.Errorf("registry answered an invalid digest: %v", err)
+	}
+	return d, nil
+}
+
+// headManifest requests the manifest at the given URL, using the given bearer token, if any.
+func (r *digestResolver) headManifest(ctx context.Context, manifestURL string, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// fetchToken requests an anonymous token to the authorization server given by the WWW-Authenticate challenge,
+// such as Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:a/b:pull"
+func (r *digestResolver) fetchToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("registry requires an unsupported authentication: %s", challenge)
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("registry answered an invalid realm: %s", challenge)
+	}
+	query := realm.Query()
+	for _, p := range []string{"service", "scope"} {
+		if params[p] != "" {
+			query.Set(p, params[p])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("authorization server answered %s", resp.Status)
+	}
+
+	tokens := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := simplejson.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("could not parse the token: %v", err)
+	}
+	if tokens.Token != "" {
+		return tokens.Token, nil
+	}
+	return tokens.AccessToken, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testDigest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// newTestRegistry starts a registry stand-in serving the manifest a:v, requiring an anonymous token,
+// and returns it along with its host and the number of manifest requests it served.
+func newTestRegistry(t *testing.T, delay time.Duration) (*httptest.Server, string, *int32) {
+	var manifestRequests int32
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			assert.Equal(t, "repository:a:pull", r.URL.Query().Get("scope"))
+			_, _ = w.Write([]byte(`{"token":"t"}`))
+		case strings.HasPrefix(r.URL.Path, "/v2/"):
+			atomic.AddInt32(&manifestRequests, 1)
+			time.Sleep(delay)
+			if r.Header.Get("Authorization") != "Bearer t" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:a:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.Method != http.MethodHead || r.URL.Path != "/v2/a/manifests/v" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			assert.Contains(t, r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", testDigest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, strings.TrimPrefix(server.URL, "https://"), &manifestRequests
+}
+
+func TestDigestResolverPinImage(t *testing.T) {
+	server, host, requests := newTestRegistry(t, 0)
+	resolver := newDigestResolver(server.Client(), time.Second, time.Minute)
+	now := time.Now()
+	resolver.now = func() time.Time { return now }
+
+	pinned, err := resolver.pinImage(context.Background(), host+"/a:v")
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/a:v@"+testDigest, pinned)
+	// Unauthorized, then authorized with the token.
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+	// Resolved from the cache.
+	pinned, err = resolver.pinImage(context.Background(), host+"/a:v")
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/a:v@"+testDigest, pinned)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+	// Resolved again once the cache expired.
+	now = now.Add(2 * time.Minute)
+	_, err = resolver.pinImage(context.Background(), host+"/a:v")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(requests))
+
+	// Already pinned.
+	pinned, err = resolver.pinImage(context.Background(), host+"/b@"+testDigest)
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/b@"+testDigest, pinned)
+	assert.Equal(t, int32(4), atomic.LoadInt32(requests))
+
+	// Unknown tag.
+	_, err = resolver.pinImage(context.Background(), host+"/a:unknown")
+	assert.NotNil(t, err)
+
+	// The expired resolutions are evicted from the cache.
+	resolver.cache["other/a:v"] = resolvedDigest{digest: testDigest, resolvedAt: now.Add(-2 * time.Minute)}
+	now = now.Add(2 * time.Minute)
+	_, err = resolver.pinImage(context.Background(), host+"/a:v")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resolver.cache))
+}
+
+func TestDigestResolverTimeout(t *testing.T) {
+	server, host, _ := newTestRegistry(t, 200*time.Millisecond)
+	resolver := newDigestResolver(server.Client(), 50*time.Millisecond, time.Minute)
+
+	ctx, cancel := resolver.requestContext()
+	defer cancel()
+	_, err := resolver.pinImage(ctx, host+"/a:v")
+	assert.NotNil(t, err)
+}
+
+func TestPinDigests(t *testing.T) {
+	server, host, _ := newTestRegistry(t, 0)
+
+	wh := mutationWH{
+		registry:            host,
+		digestResolver:      newDigestResolver(server.Client(), time.Second, time.Minute),
+		digestFailurePolicy: digestFailureIgnore,
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "a:v"},
+				{Image: "a:unknown"},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: host + "/a:v@" + testDigest},
+		{Op: "replace", Path: "/spec/containers/1/image", Value: host + "/a:unknown"},
+	}, patches)
+
+	wh.digestFailurePolicy = digestFailureFail
+	_, err = wh.applyMutationOnPod(pod)
+	assert.NotNil(t, err)
+}
+
+func TestPinDigestsOnUpdate(t *testing.T) {
+	server, host, requests := newTestRegistry(t, 0)
+
+	wh := mutationWH{
+		digestResolver:      newDigestResolver(server.Client(), time.Second, time.Minute),
+		digestFailurePolicy: digestFailureFail,
+	}
+
+	// The pods admitted unpinned are not pinned by an unrelated update, which would restart their containers.
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: host + "/a:unknown"},
+			},
+		},
+	}
+	updated := pod
+	updated.Labels = map[string]string{"a": "b"}
+	patches, err := wh.applyMutations(updateRequest(t, updated, pod, podResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+	assert.Equal(t, int32(0), atomic.LoadInt32(requests))
+
+	// The images which changed are pinned.
+	updated.Spec = corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: host + "/a:v"}}}
+	patches, err = wh.applyMutations(updateRequest(t, updated, pod, podResource))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: host + "/a:v@" + testDigest},
+	}, patches)
+}
+
+func TestPinDigestsSharedTimeout(t *testing.T) {
+	server, host, _ := newTestRegistry(t, 500*time.Millisecond)
+
+	wh := mutationWH{
+		digestResolver:      newDigestResolver(server.Client(), 100*time.Millisecond, time.Minute),
+		digestFailurePolicy: digestFailureIgnore,
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: host + "/a:v1"},
+				{Image: host + "/a:v2"},
+				{Image: host + "/a:v3"},
+			},
+		},
+	}
+
+	// The images time out together, instead of one after another, and are kept unpinned.
+	start := time.Now()
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Nil(t, patches)
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+}
+
+func TestPinDigestsWithoutRegistry(t *testing.T) {
+	server, host, _ := newTestRegistry(t, 0)
+
+	wh := mutationWH{
+		digestResolver: newDigestResolver(server.Client(), time.Second, time.Minute),
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: host + "/a:v"},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: host + "/a:v@" + testDigest},
+	}, patches)
+}
+
+func TestNewMutationWHDigests(t *testing.T) {
+	cfg, err := parseConfig(webhookConfig{ImagePullPolicyToForce: "Always"},
+		[]byte("pinDigests: true\ndigestResolveTimeout: 2s\ndigestCacheTTL: 1m\ndigestFailurePolicy: Fail\n"))
+	assert.Nil(t, err)
+
+	wh, err := newMutationWH(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Second, wh.digestResolver.timeout)
+	assert.Equal(t, time.Minute, wh.digestResolver.ttl)
+	assert.Equal(t, digestFailureFail, wh.digestFailurePolicy)
+
+	// Unset, the default policy applies.
+	cfg.DigestFailurePolicy = ""
+	wh, err = newMutationWH(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, digestFailureIgnore, wh.digestFailurePolicy)
+
+	cfg.DigestFailurePolicy = "Sometimes"
+	_, err = newMutationWH(cfg)
+	assert.NotNil(t, err)
+
+	_, err = parseConfig(cfg, []byte("digestCacheTTL: 60"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	livenessPath  = "/livez"
+	readinessPath = "/readyz"
+)
+
+// readinessCheck returns why the webhook is not ready to serve the admission requests, or nil if it is.
+type readinessCheck func() error
+
+// healthServer serves the liveness and the readiness of the webhook. The webhook is ready when all its
+// readiness checks pass, such that the admission requests are not routed to a misconfigured replica.
+type healthServer struct {
+	// mutex protects the readiness checks, which are set while the webhook starts.
+	mutex  sync.RWMutex
+	names  []string
+	checks map[string]readinessCheck
+}
+
+// notLoaded returns a readinessCheck failing until it is replaced by the check of the given component once loaded.
+func notLoaded(component string) readinessCheck {
+	return func() error {
+		return fmt.Errorf("the %s has not been loaded yet", component)
+	}
+}
+
+// setReadinessCheck sets the readiness check of the given name, replacing the previous one, if any.
+// The checks are run in the order they are first set.
+func (h *healthServer) setReadinessCheck(name string, check readinessCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.checks == nil {
+		h.checks = map[string]readinessCheck{}
+	}
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// ready runs the readiness checks, and returns the failures, if any.
+func (h *healthServer) ready() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var failures []string
+	for _, name := range h.names {
+		if err := h.checks[name](); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return failures
+}
+
+// routes define the routes of the http multiplexer of the health port.
+func (h *healthServer) routes(mux *http.ServeMux) {
+	// The webhook is alive as long as it serves the requests, the reloads keep the previous configuration
+	// and certificate when they fail, hence restarting it would not help.
+	mux.HandleFunc(livenessPath, func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, "ok")
+	})
+	mux.HandleFunc(readinessPath, func(w http.ResponseWriter, r *http.Request) {
+		if failures := h.ready(); len(failures) > 0 {
+			log.Debugf("Not ready: %s", strings.Join(failures, ", "))
+			writeHealth(w, http.StatusServiceUnavailable, strings.Join(failures, "\n"))
+			return
+		}
+		writeHealth(w, http.StatusOK, "ok")
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(message + "\n")); err != nil {
+		log.Printf("Could not write response: %v", err)
+	}
+}
+
+// serve serves the liveness and the readiness over plain HTTP on the given port, such that
+// the kubelet probes do not depend on the serving certificate.
+func (h *healthServer) serve(port string) {
+	mux := http.NewServeMux()
+	h.routes(mux)
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: mux,
+	}
+	log.Printf("Serving the health on port %s at %s and %s", port, livenessPath, readinessPath)
+	log.Fatal(server.ListenAndServe())
+}
+
+// certificateReady returns a readinessCheck failing while the certificate returned by the given
+// tls.Config.GetCertificate is not loaded or is expired.
+func certificateReady(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) readinessCheck {
+	return func() error {
+		certificate, err := getCertificate(nil)
+		if err != nil {
+			return err
+		}
+		if certificate.Leaf != nil && time.Now().After(certificate.Leaf.NotAfter) {
+			return fmt.Errorf("the serving certificate expired on %s", certificate.Leaf.NotAfter)
+		}
+		return nil
+	}
+}
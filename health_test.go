@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getHealth returns the status code and the body of the given path of the health routes.
+func getHealth(t *testing.T, h *healthServer, path string) (int, string) {
+	mux := http.NewServeMux()
+	h.routes(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+	return rr.Code, rr.Body.String()
+}
+
+func TestHealthServer(t *testing.T) {
+	h := &healthServer{}
+	h.setReadinessCheck("config", notLoaded("configuration"))
+	h.setReadinessCheck("certificate", notLoaded("serving certificate"))
+
+	code, _ := getHealth(t, h, livenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	code, body := getHealth(t, h, readinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "config: the configuration has not been loaded yet\ncertificate: the serving certificate has not been loaded yet\n", body)
+
+	h.setReadinessCheck("config", func() error { return nil })
+	code, body = getHealth(t, h, readinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "certificate: the serving certificate has not been loaded yet\n", body)
+
+	h.setReadinessCheck("certificate", func() error { return nil })
+	code, body = getHealth(t, h, readinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+}
+
+func TestConfigReady(t *testing.T) {
+	defaults := webhookConfig{
+		Registry:               "x.y",
+		ImagePullPolicyToForce: "Always",
+	}
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(configFile, []byte(`registry: a.b`), 0600))
+
+	assert.NotNil(t, (&webhookServer{}).configReady())
+
+	s, err := newWebhookServer(defaults, configFile, nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, s.configReady())
+
+	// Not ready while the configuration file is broken, though the previous configuration is still served.
+	assert.Nil(t, os.WriteFile(configFile, []byte(`imagePullPolicyToForce: Sometimes`), 0600))
+	_, err = s.reloadConfig()
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.configReady())
+	_, err = s.reloadConfig()
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.configReady())
+
+	// Ready again once the previous configuration is restored.
+	assert.Nil(t, os.WriteFile(configFile, []byte(`registry: a.b`), 0600))
+	reloaded, err := s.reloadConfig()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+	assert.Nil(t, s.configReady())
+}
+
+func TestCertificateReady(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile)
+
+	assert.NotNil(t, certificateReady((&keyPairReloader{}).getCertificate)())
+
+	r, err := newKeyPairReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	assert.Nil(t, certificateReady(r.getCertificate)())
+
+	certificate, _ := r.getCertificate(nil)
+	expired, leaf := *certificate, *certificate.Leaf
+	leaf.NotAfter = time.Now().Add(-time.Minute)
+	expired.Leaf = &leaf
+	err = certificateReady(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &expired, nil })()
+	assert.NotNil(t, err)
+}
@@ -1,9 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
-	corev1 "k8s.io/api/core/v1"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sqooba/go-common/logging"
@@ -11,18 +25,29 @@ import (
 )
 
 type envConfig struct {
-	TLSCertFile            string   `envconfig:"TLS_CERT_FILE" default:"/run/secrets/tls/webhook-server-tls.crt"`
-	TLSKeyFile             string   `envconfig:"TLS_KEY_FILE" default:"/run/secrets/tls/webhook-server-tls.key"`
-	Port                   string   `envconfig:"PORT" default:"8443"`
-	LogLevel               string   `envconfig:"LOG_LEVEL" default:"info"`
-	Registry               string   `envconfig:"REGISTRY"`
-	ImagePullSecret        string   `envconfig:"IMAGE_PULL_SECRET"`
-	AppendImagePullSecret  bool     `envconfig:"IMAGE_PULL_SECRET_APPEND" default:"false"`
-	ForceImagePullPolicy   bool     `envconfig:"FORCE_IMAGE_PULL_POLICY"`
-	ImagePullPolicyToForce string   `envconfig:"IMAGE_PULL_POLICY_TO_FORCE" default:"Always"`
-	DefaultStorageClass    string   `envconfig:"DEFAULT_STORAGE_CLASS"`
-	ExcludeNamespaces      []string `envconfig:"EXCLUDE_NAMESPACES"`
-	IgnoredRegistries      []string `envconfig:"IGNORED_REGISTRIES"`
+	TLSCertFile          string        `envconfig:"TLS_CERT_FILE" default:"/run/secrets/tls/webhook-server-tls.crt"`
+	TLSKeyFile           string        `envconfig:"TLS_KEY_FILE" default:"/run/secrets/tls/webhook-server-tls.key"`
+	Port                 string        `envconfig:"PORT" default:"8443"`
+	LogLevel             string        `envconfig:"LOG_LEVEL" default:"info"`
+	ConfigFile           string        `envconfig:"CONFIG_FILE"`
+	ConfigReloadInterval time.Duration `envconfig:"CONFIG_RELOAD_INTERVAL" default:"10s"`
+	TLSReloadInterval    time.Duration `envconfig:"TLS_RELOAD_INTERVAL" default:"10s"`
+	MetricsPort          string        `envconfig:"METRICS_PORT" default:"9090"`
+	HealthPort           string        `envconfig:"HEALTH_PORT" default:"8080"`
+	ShutdownDelay        time.Duration `envconfig:"SHUTDOWN_DELAY" default:"5s"`
+	ShutdownTimeout      time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"20s"`
+	ReplicateSecrets     secretList    `envconfig:"REPLICATE_SECRETS"`
+	ReplicateInterval    time.Duration `envconfig:"REPLICATE_INTERVAL" default:"5m"`
+
+	TLSBootstrap                    bool          `envconfig:"TLS_BOOTSTRAP"`
+	TLSSecretNamespace              string        `envconfig:"TLS_SECRET_NAMESPACE" default:"kube-system"`
+	TLSSecretName                   string        `envconfig:"TLS_SECRET_NAME" default:"k8s-mutate-image-and-policy-webhook-tls-certs"`
+	TLSDNSNames                     []string      `envconfig:"TLS_DNS_NAMES" default:"k8s-mutate-image-and-policy-webhook.kube-system.svc"`
+	TLSCertValidity                 time.Duration `envconfig:"TLS_CERT_VALIDITY" default:"8760h"`
+	TLSRenewBefore                  time.Duration `envconfig:"TLS_RENEW_BEFORE" default:"720h"`
+	TLSBootstrapInterval            time.Duration `envconfig:"TLS_BOOTSTRAP_INTERVAL" default:"1m"`
+	MutatingWebhookConfigurations   []string      `envconfig:"MUTATING_WEBHOOK_CONFIGURATIONS" default:"k8s-mutate-image-and-policy-webhook"`
+	ValidatingWebhookConfigurations []string      `envconfig:"VALIDATING_WEBHOOK_CONFIGURATIONS"`
 }
 
 var (
@@ -30,14 +55,36 @@ var (
 )
 
 type mutationWH struct {
-	registry               string
-	imagePullSecret        string
-	appendImagePullSecret  bool
-	forceImagePullPolicy   bool
-	imagePullPolicyToForce corev1.PullPolicy
-	defaultStorageClass    string
-	excludedNamespaces     []string
-	ignoredRegistries      []string
+	registry                     string
+	registryMapping              map[string]string
+	imagePullSecret              string
+	appendImagePullSecret        bool
+	forceImagePullPolicy         bool
+	imagePullPolicyToForce       corev1.PullPolicy
+	defaultStorageClass          string
+	storageClassPolicy           storageClassPolicy
+	storageClassMapping          map[string]string
+	excludedNamespaces           []string
+	excludedNamespaceSelector    labels.Selector
+	namespaces                   listersv1.NamespaceLister
+	ignoredRegistries            []string
+	mutateWorkloads              bool
+	allowedRegistries            []string
+	validationExcludedNamespaces []string
+	optIn                        bool
+	optOutNamespaces             []string
+	recordOriginal               bool
+	digestResolver               *digestResolver
+	digestFailurePolicy          digestFailurePolicy
+	latestTagPolicy              latestTagPolicy
+	defaultTag                   string
+	latestTagAllowedNamespaces   []string
+	pullPolicyRules              pullPolicyRules
+	registryPullSecrets          map[string]string
+	missingPullSecretPolicy      missingPullSecretPolicy
+	pullSecretTarget             pullSecretTarget
+	mutationWarnings             bool
+	secrets                      cache.GenericLister
 }
 
 func main() {
@@ -53,32 +100,76 @@ func main() {
 		return
 	}
 
+	// The rules of the webhook, which are the defaults of the configuration file, if any.
+	var rules webhookConfig
+	if err := envconfig.Process("", &rules); err != nil {
+		log.Printf("[ERROR] Failed to process env var: %s\n", err)
+		return
+	}
+
+	printNamespaceSelector := flag.Bool("print-namespace-selector", false,
+		"print the namespaceSelector of the MutatingWebhookConfiguration matching the excluded namespaces, and exit")
 	flag.Parse()
 	err := logging.SetLogLevel(log, env.LogLevel)
 	if err != nil {
 		log.Fatalf("Logging level %s do not seem to be right. Err = %v", env.LogLevel, err)
 	}
 
-	// Validate pull policy
-	pullPolicyValid, pullPolicyToForce := isPullPolicyValid(env.ImagePullPolicyToForce)
-	if !pullPolicyValid {
-		log.Fatalf("Pull policy %s is not valid. Fix IMAGE_PULL_POLICY_TO_FORCE and retry", env.ImagePullPolicyToForce)
+	if *printNamespaceSelector {
+		if err := printMutatingNamespaceSelector(rules, env.ConfigFile); err != nil {
+			log.Fatalf("Could not generate the namespaceSelector: %v", err)
+		}
+		return
+	}
+
+	// The health is served first, such that the webhook is not ready until the configuration and the certificate are loaded.
+	health := &healthServer{}
+	health.setReadinessCheck("config", notLoaded("configuration"))
+	health.setReadinessCheck("certificate", notLoaded("serving certificate"))
+	go health.serve(env.HealthPort)
+
+	// The kube clients are only available when running in a cluster, which is not the case while hacking locally.
+	var kubeClient kubernetes.Interface
+	var metadataClient metadata.Interface
+	if restConfig, err := rest.InClusterConfig(); err != nil {
+		log.Printf("Not running in a cluster, the rules looking up objects from the API server are not available: %v", err)
+	} else if kubeClient, err = kubernetes.NewForConfig(restConfig); err != nil {
+		log.Fatalf("Could not create the kube client: %v", err)
+	} else if metadataClient, err = metadata.NewForConfig(restConfig); err != nil {
+		log.Fatalf("Could not create the kube metadata client: %v", err)
+	}
+
+	webhook, err := newWebhookServer(rules, env.ConfigFile, kubeClient, metadataClient)
+	if err != nil {
+		log.Fatalf("Configuration is not valid: %v", err)
+	}
+	health.setReadinessCheck("config", webhook.configReady)
+	if env.ConfigFile != "" {
+		log.Printf("Configuration loaded from %s, watching it every %s", env.ConfigFile, env.ConfigReloadInterval)
+		go webhook.watchConfigFile(env.ConfigReloadInterval, nil)
 	}
 
-	wh := mutationWH{
-		registry:               env.Registry,
-		imagePullSecret:        env.ImagePullSecret,
-		appendImagePullSecret:  env.AppendImagePullSecret,
-		forceImagePullPolicy:   env.ForceImagePullPolicy,
-		imagePullPolicyToForce: pullPolicyToForce,
-		defaultStorageClass:    env.DefaultStorageClass,
-		excludedNamespaces:     env.ExcludeNamespaces,
-		ignoredRegistries:      env.IgnoredRegistries,
+	if len(env.ReplicateSecrets) > 0 {
+		if kubeClient == nil {
+			log.Fatalf("The secrets cannot be replicated when not running in a cluster, unset REPLICATE_SECRETS and retry")
+		}
+		replicator := &secretReplicator{
+			client:  kubeClient,
+			sources: env.ReplicateSecrets,
+			// the secrets are replicated into the namespaces mutated with the current configuration.
+			isExcluded: func(ns string) bool { return webhook.current.Load().isExcludedFromMutation(ns) },
+		}
+		log.Printf("Replicating secrets %v into the namespaces which are not excluded, every %s", env.ReplicateSecrets, env.ReplicateInterval)
+		go replicator.run(env.ReplicateInterval, nil)
+	}
+
+	if env.MetricsPort != "" {
+		go serveMetrics(env.MetricsPort)
 	}
 
 	mux := http.NewServeMux()
 
-	wh.routes(mux, env)
+	webhook.routes(mux)
 
 	server := &http.Server{
 		// We listen on port 8443 such that we do not need root privileges or extra capabilities for this server.
@@ -87,5 +178,58 @@ func main() {
 		Handler: mux,
 	}
 
-	log.Fatal(server.ListenAndServeTLS(env.TLSCertFile, env.TLSKeyFile))
+	if env.TLSBootstrap {
+		if kubeClient == nil {
+			log.Fatalf("The certificates cannot be bootstrapped when not running in a cluster, unset TLS_BOOTSTRAP and retry")
+		}
+		if len(env.TLSDNSNames) == 0 {
+			log.Fatalf("The certificates cannot be bootstrapped without DNS names, set TLS_DNS_NAMES and retry")
+		}
+		if env.TLSCertValidity <= env.TLSRenewBefore {
+			log.Fatalf("The certificates would be renewed continuously, fix TLS_CERT_VALIDITY or TLS_RENEW_BEFORE and retry")
+		}
+		bootstrapper := &certBootstrapper{
+			client:             kubeClient,
+			secret:             types.NamespacedName{Namespace: env.TLSSecretNamespace, Name: env.TLSSecretName},
+			dnsNames:           env.TLSDNSNames,
+			mutatingWebhooks:   env.MutatingWebhookConfigurations,
+			validatingWebhooks: env.ValidatingWebhookConfigurations,
+			validity:           env.TLSCertValidity,
+			renewBefore:        env.TLSRenewBefore,
+			now:                time.Now,
+		}
+		if err := bootstrapper.reconcile(context.Background()); err != nil {
+			log.Fatalf("Could not bootstrap the certificates: %v", err)
+		}
+		go bootstrapper.run(env.TLSBootstrapInterval, nil)
+		server.TLSConfig = &tls.Config{GetCertificate: bootstrapper.getCertificate}
+		health.setReadinessCheck("certificate", certificateReady(bootstrapper.getCertificate))
+	} else {
+		reloader, err := newKeyPairReloader(env.TLSCertFile, env.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Could not load the serving certificate: %v", err)
+		}
+		log.Printf("Serving certificate loaded from %s, watching it every %s", env.TLSCertFile, env.TLSReloadInterval)
+		go reloader.watch(env.TLSReloadInterval, nil)
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.getCertificate}
+		health.setReadinessCheck("certificate", certificateReady(reloader.getCertificate))
+	}
+
+	// On SIGTERM, the in-flight requests are drained, instead of failing or leaving the pods unmutated.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	stopped := make(chan struct{})
+	go func() {
+		if err := shutdownOnSignal(server, health, signals, env.ShutdownDelay, env.ShutdownTimeout); err != nil {
+			log.Errorf("Could not drain the in-flight requests: %v", err)
+		}
+		close(stopped)
+	}()
+
+	// The certificate is served by the GetCertificate of the TLS config, such that it is reloaded without restart.
+	if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("k8s-mutate-image-and-policy-webhook is stopped")
 }
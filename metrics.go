@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+const (
+	// metricsNamespace prefixes the names of all the metrics of the webhook.
+	metricsNamespace = "k8s_mutate_image_and_policy"
+	// metricsPath is the path the metrics are served at, on the metrics port.
+	metricsPath = "/metrics"
+
+	// The outcomes of the admission requests.
+	outcomeAllowed = "allowed"
+	outcomeDenied  = "denied"
+	outcomeError   = "error"
+)
+
+var (
+	// admissionRequests counts the admission requests, by resource, operation, namespace and outcome.
+	admissionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "Number of admission requests, by resource, operation, namespace and outcome, i.e. allowed, denied or error.",
+	}, []string{"resource", "operation", "namespace", "outcome"})
+
+	// admissionDuration observes the time spent serving the admission requests.
+	admissionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_duration_seconds",
+		Help:      "Time spent serving the admission requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// admissionPatches counts the patch operations returned to the API server, by mutation type.
+	admissionPatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patches_total",
+		Help:      "Number of patch operations returned to the API server, by mutation type.",
+	}, []string{"mutation"})
+
+	// certificateReloads counts the reloads of the serving certificate, by result, i.e. success or error.
+	certificateReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_reloads_total",
+		Help:      "Number of reloads of the serving certificate, by result.",
+	}, []string{"result"})
+
+	// certificateExpiry is the expiry time of the serving certificate.
+	certificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry time of the serving certificate, in seconds since epoch.",
+	})
+)
+
+// recordAdmission records the metrics of an admission request, nil if it could not be parsed, given its response.
+func recordAdmission(req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse) {
+	var resource, operation, namespace string
+	if req != nil {
+		resource, operation, namespace = req.Resource.Resource, string(req.Operation), req.Namespace
+		if req.SubResource != "" {
+			resource += "/" + req.SubResource
+		}
+	}
+
+	outcome := outcomeAllowed
+	if resp == nil || !resp.Allowed {
+		outcome = outcomeError
+		if resp != nil && resp.Result != nil && resp.Result.Code == http.StatusForbidden {
+			outcome = outcomeDenied
+		}
+	}
+	admissionRequests.WithLabelValues(resource, operation, namespace, outcome).Inc()
+}
+
+// recordPatches records the given patch operations, by mutation type.
+func recordPatches(patchOps []patchOperation) {
+	for _, p := range patchOps {
+		if mutation := p.mutation(); mutation != "" {
+			admissionPatches.WithLabelValues(string(mutation)).Inc()
+		}
+	}
+}
+
+// recordCertificateExpiry records the expiry time of the serving certificate.
+func recordCertificateExpiry(notAfter time.Time) {
+	certificateExpiry.Set(float64(notAfter.Unix()))
+}
+
+// metricsRoutes define the routes of the http multiplexer of the metrics port.
+func metricsRoutes(mux *http.ServeMux) {
+	mux.Handle(metricsPath, promhttp.Handler())
+}
+
+// serveMetrics serves the metrics over plain HTTP on the given port, such that Prometheus does not need
+// the CA of the webhook to scrape them.
+func serveMetrics(port string) {
+	mux := http.NewServeMux()
+	metricsRoutes(mux)
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: mux,
+	}
+	log.Printf("Serving the metrics on port %s at %s", port, metricsPath)
+	log.Fatal(server.ListenAndServe())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestAdmissionMetrics(t *testing.T) {
+
+	wh := mutationWH{
+		registry:          "x.y",
+		allowedRegistries: []string{"x.y"},
+	}
+
+	raw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "a:v"},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	req := &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Resource:  podResource,
+		Operation: admissionv1.Create,
+		Namespace: "metrics",
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+
+	allowed := admissionRequests.WithLabelValues("pods", "CREATE", "metrics", outcomeAllowed)
+	denied := admissionRequests.WithLabelValues("pods", "CREATE", "metrics", outcomeDenied)
+	failed := admissionRequests.WithLabelValues("pods", "CREATE", "metrics", outcomeError)
+	images := admissionPatches.WithLabelValues(string(mutationImage))
+	initialAllowed, initialDenied, initialFailed, initialImages :=
+		testutil.ToFloat64(allowed), testutil.ToFloat64(denied), testutil.ToFloat64(failed), testutil.ToFloat64(images)
+
+	postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), req)
+	assert.Equal(t, initialAllowed+1, testutil.ToFloat64(allowed))
+	assert.Equal(t, initialImages+1, testutil.ToFloat64(images))
+
+	postAdmissionReview(t, wh.admitFuncHandler(wh.validateImages, wh.isExcludedFromValidation), req)
+	assert.Equal(t, initialDenied+1, testutil.ToFloat64(denied))
+
+	req.Object = runtime.RawExtension{Raw: []byte(`{"spec": 1}`)}
+	postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), req)
+	assert.Equal(t, initialFailed+1, testutil.ToFloat64(failed))
+}
+
+func TestCertificateExpiryMetric(t *testing.T) {
+	notAfter := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	recordCertificateExpiry(notAfter)
+	assert.Equal(t, float64(notAfter.Unix()), testutil.ToFloat64(certificateExpiry))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	recordAdmission(nil, nil)
+
+	mux := http.NewServeMux()
+	metricsRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "k8s_mutate_image_and_policy_admission_requests_total"))
+	assert.True(t, strings.Contains(w.Body.String(), "k8s_mutate_image_and_policy_admission_duration_seconds"))
+}
@@ -1,22 +1,53 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
+	"github.com/distribution/reference"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// dockerHubRegistry is the registry of images not specifying any registry.
+	dockerHubRegistry = "docker.io"
+	// ephemeralContainersSubResource is the pod subresource used to add ephemeral containers, i.e. by kubectl debug.
+	ephemeralContainersSubResource = "ephemeralcontainers"
+)
+
+// storageClassPolicy tells how the storage class of pvcs and pvc templates is enforced.
+type storageClassPolicy string
+
+const (
+	// storageClassIfMissing only sets the default storage class when no storage class is set.
+	storageClassIfMissing storageClassPolicy = "IfMissing"
+	// storageClassForce replaces any storage class by the default one, the default policy.
+	storageClassForce storageClassPolicy = "Force"
+	// storageClassTranslate replaces the storage classes found in the storage class mapping,
+	// and sets the default storage class when no storage class is set.
+	storageClassTranslate storageClassPolicy = "Translate"
+)
+
 var (
 	podResource         = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
 	volumeClaimResource = metav1.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}
 )
 
+// mutationWarning returns the warning describing a mutation, returned to the client along with the response,
+// if the mutation warnings are enabled, or an empty string otherwise.
+func (wh *mutationWH) mutationWarning(format string, args ...interface{}) string {
+	if !wh.mutationWarnings {
+		return ""
+	}
+	return fmt.Sprintf(format, args...)
+}
+
 // applyMutations implements the logic of our admission controller webhook.
 func (wh *mutationWH) applyMutations(req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
-	// This handler should only get called on Pod or Pvc objects as per the MutatingWebhookConfiguration in the YAML file.
+	// This handler should only get called on Pod, Pvc, ServiceAccount or workload objects as per the MutatingWebhookConfiguration in the YAML file.
 	// However, if (for whatever reason) this gets invoked on an object of a different kind, issue a log message but
 	// let the object request pass through otherwise.
 	if req.Resource == podResource {
@@ -27,8 +58,31 @@ func (wh *mutationWH) applyMutations(req *admissionv1.AdmissionRequest) ([]patch
 		if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
 			return nil, fmt.Errorf("could not deserialize pod object: %v", err)
 		}
+		// The namespace of the object is not set on creation, the annotations are honoured depending on it.
+		if pod.Namespace == "" {
+			pod.Namespace = req.Namespace
+		}
 
-		return wh.applyMutationOnPod(pod)
+		switch req.SubResource {
+		case "":
+			if req.Operation == admissionv1.Update {
+				old, err := decodeOldPod(req.OldObject.Raw)
+				if err != nil {
+					return nil, err
+				}
+				return wh.applyMutationOnPodSpec(pod.ObjectMeta, pod.Spec, &old.Spec, "")
+			}
+			return wh.applyMutationOnPod(pod)
+		case ephemeralContainersSubResource:
+			existing, err := existingEphemeralContainers(req.OldObject.Raw)
+			if err != nil {
+				return nil, err
+			}
+			return wh.applyMutationOnEphemeralContainers(pod, existing)
+		}
+
+		log.Printf("Got an unexpected subresource %s of %s, don't know what to do with...", req.SubResource, req.Resource)
+		return nil, nil
 
 	} else if req.Resource == volumeClaimResource {
 
@@ -38,137 +92,432 @@ func (wh *mutationWH) applyMutations(req *admissionv1.AdmissionRequest) ([]patch
 		if _, _, err := universalDeserializer.Decode(raw, nil, &pvc); err != nil {
 			return nil, fmt.Errorf("could not deserialize pvc object: %v", err)
 		}
+		if pvc.Namespace == "" {
+			pvc.Namespace = req.Namespace
+		}
 
 		return wh.applyMutationOnPvc(pvc)
+
+	} else if req.Resource == serviceAccountResource {
+
+		serviceAccount := corev1.ServiceAccount{}
+		if _, _, err := universalDeserializer.Decode(req.Object.Raw, nil, &serviceAccount); err != nil {
+			return nil, fmt.Errorf("could not deserialize serviceaccount object: %v", err)
+		}
+		if serviceAccount.Namespace == "" {
+			serviceAccount.Namespace = req.Namespace
+		}
+
+		return wh.applyMutationOnServiceAccount(serviceAccount, req.Operation)
+
+	} else if isWorkloadResource(req.Resource) {
+
+		return wh.applyMutationOnWorkload(req)
 	}
 
 	log.Printf("Got an unexpected resource %s, don't know what to do with...", req.Resource)
 	return nil, nil
 }
 
-// applyMutationOnPod gets the deserialized pod spec and returns the patch operations
+// applyMutationOnPod gets the deserialized pod spec of a created pod and returns the patch operations
 // to apply, if any, or an error if something went wrong.
 func (wh *mutationWH) applyMutationOnPod(pod corev1.Pod) ([]patchOperation, error) {
+	return wh.applyMutationOnPodSpec(pod.ObjectMeta, pod.Spec, nil, "")
+}
 
-	var patches []patchOperation
+// applyMutationOnPodSpec returns the patch operations to apply on the given pod spec, if any,
+// or an error if something went wrong. All the patch paths are prefixed with the given path
+// of the object holding the spec, i.e. empty for a pod, or the path of the pod template of a workload.
+// The mutations the pod opted out of, via the annotations of the given metadata, are skipped.
+// The old pod spec is the one of the object being updated, nil on creation: the policies denying or
+// changing the images only apply to the images which are not already in the old pod spec.
+func (wh *mutationWH) applyMutationOnPodSpec(meta metav1.ObjectMeta, spec corev1.PodSpec, old *corev1.PodSpec, path string) ([]patchOperation, error) {
+
+	options := wh.mutationOptions(meta)
+	if options.skip {
+		log.Debugf("Skipping the mutations of pod %s/%s", meta.Namespace, meta.Name)
+		return nil, nil
+	}
 
-	if wh.registry != "" {
-		if pod.Spec.InitContainers != nil {
-			for i, c := range pod.Spec.InitContainers {
-				log.Tracef("/spec/initContainers/%d/image = %s", i, c.Image)
+	// Ephemeral containers are not mutated here, as they can only be changed
+	// via the pods/ephemeralcontainers subresource, see applyMutationOnEphemeralContainers.
+	original := originalSpec{}
+	oldImages := containerImages(old)
+	patches, images, err := wh.applyMutationOnContainers([]containerList{
+		{path: path + "/spec/initContainers", containers: spec.InitContainers, oldImages: oldImages},
+		{path: path + "/spec/containers", containers: spec.Containers, oldImages: oldImages},
+	}, options, &original)
+	if err != nil {
+		return nil, err
+	}
+	patchesBeforePullSecret := len(patches)
 
-				if !containsAnyRegistry(c.Image, append(wh.ignoredRegistries, wh.registry)) {
-					patches = append(patches, patchOperation{
-						Op:    "replace",
-						Path:  fmt.Sprintf("/spec/initContainers/%d/image", i),
-						Value: replaceRegistryIfSet(c.Image, wh.registry),
-					})
-				}
-			}
+	if (wh.imagePullSecret != "" || len(wh.registryPullSecrets) > 0) && !options.skipPullSecret && wh.injectsPullSecretsIntoPods() {
+		secretPatches, err := wh.applyPullSecrets(spec, path, meta.Namespace, images, old != nil)
+		if err != nil {
+			return nil, err
 		}
+		patches = append(patches, secretPatches...)
+	}
 
-		if pod.Spec.Containers != nil {
-			for i, c := range pod.Spec.Containers {
-				log.Tracef("/spec/containers/%d/image = %s", i, c.Image)
+	if len(patches) > patchesBeforePullSecret {
+		pullSecrets := append([]corev1.LocalObjectReference{}, spec.ImagePullSecrets...)
+		original.ImagePullSecrets = &pullSecrets
+	}
 
-				if !containsAnyRegistry(c.Image, append(wh.ignoredRegistries, wh.registry)) {
-					patches = append(patches, patchOperation{
-						Op:    "replace",
-						Path:  fmt.Sprintf("/spec/containers/%d/image", i),
-						Value: replaceRegistryIfSet(c.Image, wh.registry),
-					})
-				}
-			}
+	// Generic ephemeral volumes are provisioned from a pvc template, enforce its storage class as for pvcs.
+	// The volumes already in the old object are left untouched on update, as the volumes of a pod are immutable:
+	// patching them would deny every update of a pod created with another storage class.
+	var oldVolumes []string
+	if old != nil {
+		for _, v := range old.Volumes {
+			oldVolumes = append(oldVolumes, v.Name)
+		}
+	}
+	for i, v := range spec.Volumes {
+		if v.Ephemeral != nil && v.Ephemeral.VolumeClaimTemplate != nil && !contains(oldVolumes, v.Name) {
+			patches = append(patches, wh.applyMutationOnPvcSpec(v.Ephemeral.VolumeClaimTemplate.Spec,
+				fmt.Sprintf("%s/spec/volumes/%d/ephemeral/volumeClaimTemplate/spec", path, i))...)
 		}
 	}
 
-	if wh.forceImagePullPolicy {
-		if pod.Spec.InitContainers != nil {
-			for i, c := range pod.Spec.InitContainers {
-				log.Tracef("/spec/initContainers/%d/imagePullPolicy = %s", i, c.ImagePullPolicy)
-				op := "replace"
-				// still take the case when ImagePullPolicy is empty, but this case should not happen.
-				// Policy defaults to Always if tag is latest, IfNotPresent otherwise.
-				if c.ImagePullPolicy == "" {
-					op = "add"
+	if wh.recordOriginal {
+		if patch, ok := originalAnnotationPatch(meta, spec, path, original); ok {
+			patches = append(patches, patch)
+		}
+	}
+
+	log.Debugf("Patch applied: %v", patches)
+
+	return patches, nil
+}
+
+// applyMutationOnEphemeralContainers gets the deserialized pod spec of a pods/ephemeralcontainers
+// subresource request, such as issued by kubectl debug, and returns the patch operations to apply
+// on its ephemeral containers, if any, or an error if something went wrong.
+// The pod level fields, such as imagePullSecrets, cannot be changed via this subresource, and neither can
+// the existing ephemeral containers, given by name, hence only the added ones are mutated.
+func (wh *mutationWH) applyMutationOnEphemeralContainers(pod corev1.Pod, existing []string) ([]patchOperation, error) {
+
+	options := wh.mutationOptions(pod.ObjectMeta)
+	if options.skip {
+		log.Debugf("Skipping the mutations of the ephemeral containers of pod %s/%s", pod.Namespace, pod.Name)
+		return nil, nil
+	}
+
+	containers := make([]corev1.Container, len(pod.Spec.EphemeralContainers))
+	for i, c := range pod.Spec.EphemeralContainers {
+		// EphemeralContainerCommon has the very same fields as Container.
+		containers[i] = corev1.Container(c.EphemeralContainerCommon)
+	}
+
+	patches, _, err := wh.applyMutationOnContainers([]containerList{
+		{path: "/spec/ephemeralContainers", containers: containers, immutable: existing},
+	}, options, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Patch applied: %v", patches)
+
+	return patches, nil
+}
+
+// existingEphemeralContainers returns the names of the ephemeral containers of the given raw pod, which is
+// the old object of a pods/ephemeralcontainers subresource request, if any.
+func existingEphemeralContainers(raw []byte) ([]string, error) {
+	pod, err := decodeOldPod(raw)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, c := range pod.Spec.EphemeralContainers {
+		names = append(names, c.Name)
+	}
+	return names, nil
+}
+
+// decodeOldPod deserializes the given raw pod, which is the old object of an update request,
+// an empty pod being returned if the request does not have any.
+func decodeOldPod(raw []byte) (corev1.Pod, error) {
+	pod := corev1.Pod{}
+	if len(raw) == 0 {
+		return pod, nil
+	}
+	if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
+		return pod, fmt.Errorf("could not deserialize old pod object: %v", err)
+	}
+	return pod, nil
+}
+
+// containerImages returns the images of the init containers and containers of the given pod spec, by name,
+// or nil if there is no pod spec.
+func containerImages(spec *corev1.PodSpec) map[string]string {
+	if spec == nil {
+		return nil
+	}
+	images := map[string]string{}
+	for _, c := range spec.InitContainers {
+		images[c.Name] = c.Image
+	}
+	for _, c := range spec.Containers {
+		images[c.Name] = c.Image
+	}
+	return images
+}
+
+// containerList is a list of containers of a pod, along with the JSON path of the list.
+type containerList struct {
+	path       string
+	containers []corev1.Container
+	// immutable are the names of the containers which cannot be mutated, such as the existing ephemeral containers.
+	immutable []string
+	// oldImages are the images of the containers in the old object, by name, on update.
+	oldImages map[string]string
+}
+
+// imageChanged returns true if the image of the given container is not the one it has in the old object,
+// which is always the case on creation.
+func (l containerList) imageChanged(c corev1.Container) bool {
+	old, ok := l.oldImages[c.Name]
+	return !ok || old != c.Image
+}
+
+// skips returns true if the given container is not mutated, as it is immutable or skipped by the options.
+func (l containerList) skips(options mutationOptions, name string) bool {
+	return contains(l.immutable, name) || options.skipsContainer(name)
+}
+
+// applyMutationOnContainers returns the patch operations rewriting the images of the given
+// lists of containers, followed by the ones setting their pull policy, unless skipped by the options.
+// The pull policy is set by the first pull policy rule matching the final image of the container,
+// or forced to the pull policy to force, if enabled, when no rule matches. The original values of the mutated fields are recorded in the given originalSpec, if not nil.
+// An error is returned if the digest of an image cannot be resolved, and the digest failure policy is Fail,
+// or a forbiddenError if images use the latest tag, and the latest tag policy is Deny.
+// The images of all the containers after their mutation are returned along with the patch operations.
+func (wh *mutationWH) applyMutationOnContainers(lists []containerList, options mutationOptions, original *originalSpec) ([]patchOperation, []string, error) {
+
+	var patches []patchOperation
+	// the images after their mutation, by path, which the pull policy rules apply to.
+	images := map[string]string{}
+
+	mutatesImages := wh.registry != "" || len(wh.registryMapping) > 0 || wh.digestResolver != nil ||
+		(options.latestTagPolicy != latestTagAllow && options.latestTagPolicy != "")
+	if mutatesImages && !options.skipRegistry {
+		// All the images share the timeout of the resolution of their digests.
+		ctx := context.Background()
+		if wh.digestResolver != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = wh.digestResolver.requestContext()
+			defer cancel()
+		}
+		var latestViolations []string
+		for _, l := range lists {
+			for i, c := range l.containers {
+				if l.skips(options, c.Name) {
+					continue
+				}
+				log.Tracef("%s/%d/image = %s", l.path, i, c.Image)
+
+				// The latest tag policy and the pinning only apply to the new images, such that the objects created
+				// before are still updatable, and that their containers are not restarted by an unrelated update.
+				changed := l.imageChanged(c)
+				image, retagged, violation := c.Image, false, ""
+				if changed {
+					image, retagged, violation = wh.applyLatestTagPolicy(c.Name, c.Image, options.latestTagPolicy)
+				}
+				if violation != "" {
+					latestViolations = append(latestViolations, violation)
+					continue
+				}
+				image, rewritten := wh.rewriteImage(image)
+				pinned := false
+				if changed {
+					var err error
+					if image, pinned, err = wh.pinImage(ctx, image); err != nil {
+						return nil, nil, err
+					}
 				}
-				if wh.imagePullPolicyToForce != c.ImagePullPolicy {
+				images[fmt.Sprintf("%s/%d", l.path, i)] = image
+				if retagged || rewritten || pinned {
+					original.recordImage(c.Name, c.Image)
 					patches = append(patches, patchOperation{
-						Op:    op,
-						Path:  fmt.Sprintf("/spec/initContainers/%d/imagePullPolicy", i),
-						Value: wh.imagePullPolicyToForce,
+						Op:      "replace",
+						Path:    fmt.Sprintf("%s/%d/image", l.path, i),
+						Value:   image,
+						warning: wh.mutationWarning("container %q image %q replaced by %q", c.Name, c.Image, image),
 					})
 				}
 			}
 		}
+		if len(latestViolations) > 0 {
+			return nil, nil, &forbiddenError{message: fmt.Sprintf("%s use the %s tag, set an explicit tag",
+				strings.Join(latestViolations, ", "), latestTag)}
+		}
+	}
+
+	if (wh.forceImagePullPolicy || len(wh.pullPolicyRules) > 0) && !options.skipPullPolicy {
+		for _, l := range lists {
+			for i, c := range l.containers {
+				if l.skips(options, c.Name) {
+					continue
+				}
+				log.Tracef("%s/%d/imagePullPolicy = %s", l.path, i, c.ImagePullPolicy)
 
-		if pod.Spec.Containers != nil {
-			for i, c := range pod.Spec.Containers {
-				log.Tracef("/spec/containers/%d/imagePullPolicy = %s", i, c.ImagePullPolicy)
-				if c.ImagePullPolicy != wh.imagePullPolicyToForce {
+				image := finalImage(images, l.path, i, c)
+				pullPolicy, matched := wh.pullPolicyRules.pullPolicyFor(image, options.namespace)
+				if !matched {
+					if !wh.forceImagePullPolicy {
+						continue
+					}
+					pullPolicy = wh.imagePullPolicyToForce
+				}
+
+				if c.ImagePullPolicy != pullPolicy {
 					op := "replace"
+					warning := wh.mutationWarning("container %q imagePullPolicy %s replaced by %s", c.Name, c.ImagePullPolicy, pullPolicy)
+					// still take the case when ImagePullPolicy is empty, but this case should not happen.
+					// Policy defaults to Always if tag is latest, IfNotPresent otherwise.
 					if c.ImagePullPolicy == "" {
 						op = "add"
+						warning = wh.mutationWarning("container %q imagePullPolicy set to %s", c.Name, pullPolicy)
 					}
+					original.recordImagePullPolicy(c.Name, c.ImagePullPolicy)
 					patches = append(patches, patchOperation{
-						Op:    op,
-						Path:  fmt.Sprintf("/spec/containers/%d/imagePullPolicy", i),
-						Value: wh.imagePullPolicyToForce,
+						Op:      op,
+						Path:    fmt.Sprintf("%s/%d/imagePullPolicy", l.path, i),
+						Value:   pullPolicy,
+						warning: warning,
 					})
 				}
 			}
 		}
 	}
 
-	if wh.imagePullSecret != "" {
-		// if there are no existing pull secrets, append or replace is the same operation.
-		if pod.Spec.ImagePullSecrets == nil {
-			patches = append(patches, patchOperation{
-				Op:    "add",
-				Path:  "/spec/imagePullSecrets",
-				Value: []map[string]string{{"name": wh.imagePullSecret}},
-			})
-		} else {
-			if wh.appendImagePullSecret {
-				// in the append branch,
-				// in case of existing secrets in the pod, we check if the secret does not exist and we append it to the list
-				imagePullSecretsAlreadyExist := false
-				for _, i := range pod.Spec.ImagePullSecrets {
-					if i.Name == wh.imagePullSecret {
-						imagePullSecretsAlreadyExist = true
-						break
-					}
-				}
-				if !imagePullSecretsAlreadyExist {
-					patches = append(patches, patchOperation{
-						Op:    "add",
-						Path:  fmt.Sprintf("/spec/imagePullSecrets/%d", len(pod.Spec.ImagePullSecrets)),
-						Value: []map[string]string{{"name": wh.imagePullSecret}},
-					})
-				}
-			} else {
-				// in the replace branch,
-				// if the secret is not the one to set, we replace the existing secret(s)
-				if !(len(pod.Spec.ImagePullSecrets) == 1 && pod.Spec.ImagePullSecrets[0].Name == wh.imagePullSecret) {
-					patches = append(patches, patchOperation{
-						Op:    "replace",
-						Path:  "/spec/imagePullSecrets",
-						Value: []map[string]string{{"name": wh.imagePullSecret}},
-					})
-				}
-			}
+	var finalImages []string
+	for _, l := range lists {
+		for i, c := range l.containers {
+			finalImages = append(finalImages, finalImage(images, l.path, i, c))
 		}
 	}
 
-	log.Debugf("Patch applied: %v", patches)
+	return patches, finalImages, nil
+}
 
-	return patches, nil
+// finalImage returns the image of the container at the given index of the list at the given path
+// after its mutation, found in the given images by path, or its image if it has not been mutated.
+func finalImage(images map[string]string, path string, i int, c corev1.Container) string {
+	if image, ok := images[fmt.Sprintf("%s/%d", path, i)]; ok {
+		return image
+	}
+	return c.Image
 }
 
-// replaceRegistryIfSet assumes the image format is a.b[:port]/c/d:e
-// if a.b is present, it is replaced by the registry given as argument.
+// pinImage returns the image pinned to the digest of its tag, and whether it has been pinned, if digest pinning
+// is enabled. If the digest cannot be resolved, an error is returned if the digest failure policy is Fail,
+// and the image is kept unpinned otherwise.
+func (wh *mutationWH) pinImage(ctx context.Context, image string) (string, bool, error) {
+	if wh.digestResolver == nil {
+		return image, false, nil
+	}
+	pinned, err := wh.digestResolver.pinImage(ctx, image)
+	if err != nil {
+		if wh.digestFailurePolicy == digestFailureFail {
+			return image, false, err
+		}
+		log.Errorf("%v, keeping the image unpinned", err)
+		return image, false, nil
+	}
+	return pinned, pinned != image, nil
+}
+
+// rewriteImage returns the image rewritten to its target registry, and whether it has been rewritten.
+// Images already pulled from one of the target registries, or from an ignored registry, are left untouched,
+// the images without registry being pulled from docker.io.
+func (wh *mutationWH) rewriteImage(image string) (string, bool) {
+	registry := wh.targetRegistry(image)
+	untouched := wh.untouchedRegistries()
+	if registry == "" || containsAnyRegistry(image, untouched) || contains(untouched, sourceRegistry(image)) {
+		return image, false
+	}
+	return replaceRegistryIfSet(image, registry), true
+}
+
+// targetRegistry returns the registry the given image has to be pulled from. The source registry
+// of the image is looked up in the registry mapping first, falling back to the default registry otherwise.
+// An empty string means the image does not have to be rewritten.
+func (wh *mutationWH) targetRegistry(image string) string {
+	if registry, ok := wh.registryMapping[sourceRegistry(image)]; ok {
+		return registry
+	}
+	return wh.registry
+}
+
+// untouchedRegistries returns the ignored registries, along with all the registries
+// images can be rewritten to, i.e. the default one and the targets of the mapping.
+func (wh *mutationWH) untouchedRegistries() []string {
+	registries := make([]string, 0, len(wh.ignoredRegistries)+len(wh.registryMapping)+1)
+	registries = append(registries, wh.ignoredRegistries...)
+	if wh.registry != "" {
+		registries = append(registries, wh.registry)
+	}
+	for _, registry := range wh.registryMapping {
+		registries = append(registries, registry)
+	}
+	return registries
+}
+
+// sourceRegistry returns the registry the image is pulled from, i.e. the domain of the
+// normalized image reference, which is docker.io if the image does not contain any registry.
+func sourceRegistry(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return legacySourceRegistry(image)
+	}
+	return reference.Domain(named)
+}
+
+// replaceRegistryIfSet parses the image following the docker distribution reference grammar
+// [domain[:port]/]path[:tag][@digest], where the domain is either localhost, contains a . or a port,
+// and replaces the domain, if any, by the registry given as argument, or prepends the latter otherwise.
+// Docker hub images keep their short name, i.e. docker.io/library/a:v is rewritten to registry/a:v.
+// Images which are not valid references fall back to the legacy heuristic.
 func replaceRegistryIfSet(image string, registry string) string {
 
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		log.Debugf("Image %s is not a valid reference, falling back to the legacy heuristic: %v", image, err)
+		return legacyReplaceRegistry(image, registry)
+	}
+
+	path := reference.Path(named)
+	if reference.Domain(named) == dockerHubRegistry {
+		path = reference.FamiliarName(named)
+	}
+
+	rewritten := registry + "/" + path
+	if tagged, ok := named.(reference.Tagged); ok {
+		rewritten += ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		rewritten += "@" + digested.Digest().String()
+	}
+	return rewritten
+}
+
+// legacySourceRegistry returns the first part of the image if it contains a ., docker.io otherwise.
+func legacySourceRegistry(image string) string {
+	imageParts := strings.Split(image, "/")
+	if len(imageParts) > 1 && strings.Contains(imageParts[0], ".") {
+		return imageParts[0]
+	}
+	return dockerHubRegistry
+}
+
+// legacyReplaceRegistry assumes the image format is a.b[:port]/c/d:e
+// if a.b is present, it is replaced by the registry given as argument.
+func legacyReplaceRegistry(image string, registry string) string {
+
 	imageParts := strings.Split(image, "/")
 
 	if len(imageParts) == 1 {
@@ -190,29 +539,64 @@ func replaceRegistryIfSet(image string, registry string) string {
 // to apply, if any, or an error if something went wrong.
 func (wh *mutationWH) applyMutationOnPvc(pvc corev1.PersistentVolumeClaim) ([]patchOperation, error) {
 
+	if wh.mutationOptions(pvc.ObjectMeta).skip {
+		log.Debugf("Skipping the mutations of pvc %s/%s", pvc.Namespace, pvc.Name)
+		return nil, nil
+	}
+
+	patches := wh.applyMutationOnPvcSpec(pvc.Spec, "/spec")
+
+	log.Debugf("Patch applied: %v", patches)
+
+	return patches, nil
+}
+
+// applyMutationOnPvcSpec returns the patch operations enforcing the storage class of the given
+// pvc spec, located at the given path, i.e. /spec for a pvc, or the path of a pvc template,
+// such as the volume claim templates of a statefulset or the generic ephemeral volumes of a pod.
+func (wh *mutationWH) applyMutationOnPvcSpec(spec corev1.PersistentVolumeClaimSpec, path string) []patchOperation {
+
 	var patches []patchOperation
 
-	if wh.defaultStorageClass != "" {
-		if pvc.Spec.StorageClassName != nil {
-			if *pvc.Spec.StorageClassName != wh.defaultStorageClass {
-				patches = append(patches, patchOperation{
-					Op:    "replace",
-					Path:  "/spec/storageClassName",
-					Value: wh.defaultStorageClass,
-				})
-			}
-		} else {
+	if spec.StorageClassName == nil {
+		// all the policies set the default storage class, if any, when no storage class is set.
+		if wh.defaultStorageClass != "" {
 			patches = append(patches, patchOperation{
-				Op:    "add",
-				Path:  "/spec/storageClassName",
-				Value: wh.defaultStorageClass,
+				Op:      "add",
+				Path:    path + "/storageClassName",
+				Value:   wh.defaultStorageClass,
+				warning: wh.mutationWarning("storage class set to %q", wh.defaultStorageClass),
 			})
 		}
+		return patches
 	}
 
-	log.Debugf("Patch applied: %v", patches)
+	storageClass := *spec.StorageClassName
+	switch wh.storageClassPolicy {
+	case storageClassIfMissing:
+		// a storage class is already set, keep it.
+	case storageClassTranslate:
+		if translated, ok := wh.storageClassMapping[storageClass]; ok && translated != storageClass {
+			patches = append(patches, patchOperation{
+				Op:      "replace",
+				Path:    path + "/storageClassName",
+				Value:   translated,
+				warning: wh.mutationWarning("storage class %q replaced by %q", storageClass, translated),
+			})
+		}
+	default:
+		// storageClassForce, the default policy.
+		if wh.defaultStorageClass != "" && storageClass != wh.defaultStorageClass {
+			patches = append(patches, patchOperation{
+				Op:      "replace",
+				Path:    path + "/storageClassName",
+				Value:   wh.defaultStorageClass,
+				warning: wh.mutationWarning("storage class %q replaced by %q", storageClass, wh.defaultStorageClass),
+			})
+		}
+	}
 
-	return patches, nil
+	return patches
 }
 
 // containsRegistry returns true if the image "contains",
@@ -232,6 +616,17 @@ func containsAnyRegistry(image string, registries []string) bool {
 	return false
 }
 
+func isStorageClassPolicyValid(policy string) (bool, storageClassPolicy) {
+	switch storageClassPolicy(policy) {
+	case "":
+		return true, storageClassForce
+	case storageClassIfMissing, storageClassForce, storageClassTranslate:
+		return true, storageClassPolicy(policy)
+	default:
+		return false, storageClassForce
+	}
+}
+
 func isPullPolicyValid(policy string) (bool, corev1.PullPolicy) {
 	switch policy {
 	case string(corev1.PullAlways):
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/sqooba/go-common/logging"
 
 	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestImageNotSet(t *testing.T) {
@@ -400,6 +403,32 @@ func TestImageInternalFullRegistryWithIgnoreReplace2(t *testing.T) {
 	assert.Equal(t, "docker.sqooba.io/public-docker-virtual/whatever/xyz/image:snapshot", patches[0].Value)
 }
 
+func TestImageIgnoredImplicitRegistry(t *testing.T) {
+
+	wh := mutationWH{
+		registry:          "r.io",
+		ignoredRegistries: []string{"docker.io"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "nginx:1"},
+				{Image: "docker.io/nginx:1"},
+				{Image: "bitnami/redis:7"},
+				{Image: "quay.io/a:v"},
+			},
+		},
+	}
+
+	// The images without registry are pulled from docker.io, hence ignored as well.
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "/spec/containers/3/image", patches[0].Path)
+	assert.Equal(t, "r.io/a:v", patches[0].Value)
+}
+
 func TestImageExternal(t *testing.T) {
 
 	wh := mutationWH{
@@ -445,6 +474,155 @@ func TestImageExternalPathPrefixShortImage(t *testing.T) {
 	assert.Equal(t, "docker.sqooba.io/public-docker-virtual/victoriametrics/victoria-metrics:v1.40.0", patches[0].Value)
 }
 
+func TestImageRegistryMapping(t *testing.T) {
+
+	wh := mutationWH{
+		registry: "harbor.corp/default",
+		registryMapping: map[string]string{
+			"docker.io": "harbor.corp/dockerhub",
+			"quay.io":   "harbor.corp/quay",
+		},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Image: "busybox:1.28"},
+			},
+			Containers: []corev1.Container{
+				{Image: "quay.io/argoproj/argocd:v2.0.1"},
+				{Image: "ghcr.io/org/image:v1"},
+				{Image: "victoriametrics/victoria-metrics:v1.40.0"},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(patches))
+	assert.Equal(t, "/spec/initContainers/0/image", patches[0].Path)
+	assert.Equal(t, "harbor.corp/dockerhub/busybox:1.28", patches[0].Value)
+	assert.Equal(t, "/spec/containers/0/image", patches[1].Path)
+	assert.Equal(t, "harbor.corp/quay/argoproj/argocd:v2.0.1", patches[1].Value)
+	assert.Equal(t, "/spec/containers/1/image", patches[2].Path)
+	assert.Equal(t, "harbor.corp/default/org/image:v1", patches[2].Value)
+	assert.Equal(t, "/spec/containers/2/image", patches[3].Path)
+	assert.Equal(t, "harbor.corp/dockerhub/victoriametrics/victoria-metrics:v1.40.0", patches[3].Value)
+}
+
+func TestImageRegistryMappingWithoutDefault(t *testing.T) {
+
+	wh := mutationWH{
+		registryMapping: map[string]string{
+			"quay.io": "harbor.corp/quay",
+		},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "ghcr.io/org/image:v1"},
+				{Image: "quay.io/argoproj/argocd:v2.0.1"},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "/spec/containers/1/image", patches[0].Path)
+	assert.Equal(t, "harbor.corp/quay/argoproj/argocd:v2.0.1", patches[0].Value)
+}
+
+func TestImageAlreadyInMappedRegistry(t *testing.T) {
+
+	wh := mutationWH{
+		registry: "harbor.corp/default",
+		registryMapping: map[string]string{
+			"docker.io": "harbor.corp/dockerhub",
+			"quay.io":   "harbor.corp/quay",
+		},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "harbor.corp/dockerhub/busybox:1.28"},
+				{Image: "harbor.corp/quay/argoproj/argocd:v2.0.1"},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
+func TestReplaceRegistryIfSet(t *testing.T) {
+
+	// Cases of the README, assuming the registry is r.
+	cases := []struct {
+		image    string
+		expected string
+	}{
+		{"a", "r/a"},
+		{"a:v", "r/a:v"},
+		{"a/b:v", "r/a/b:v"},
+		{"a/b/c:v", "r/a/b/c:v"},
+		{"a.b/c:v", "r/c:v"},
+		{"a.b:80/c:v", "r/c:v"},
+		{"localhost/a:v", "r/a:v"},
+		{"localhost:5000/a:v", "r/a:v"},
+		{"myregistry:5000/a/b:v", "r/a/b:v"},
+		{"[::1]:5000/a:v", "r/a:v"},
+		{"docker.io/a:v", "r/a:v"},
+		{"docker.io/library/a:v", "r/a:v"},
+		{"index.docker.io/a/b:v", "r/a/b:v"},
+		{"a@sha256:a4a729d8691ed70eb56cf03053333cf42e8a6c33f6ee67ea862da4459d7f70fd", "r/a@sha256:a4a729d8691ed70eb56cf03053333cf42e8a6c33f6ee67ea862da4459d7f70fd"},
+		{"a.b/c:v@sha256:a4a729d8691ed70eb56cf03053333cf42e8a6c33f6ee67ea862da4459d7f70fd", "r/c:v@sha256:a4a729d8691ed70eb56cf03053333cf42e8a6c33f6ee67ea862da4459d7f70fd"},
+		{"a.b:v", "r/a.b:v"},
+		// not a valid reference, handled by the legacy heuristic
+		{"a.b:c/d:v", "r/d:v"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, replaceRegistryIfSet(c.image, "r"), c.image)
+	}
+}
+
+func TestSourceRegistry(t *testing.T) {
+	assert.Equal(t, "docker.io", sourceRegistry("a:v"))
+	assert.Equal(t, "docker.io", sourceRegistry("a/b:v"))
+	assert.Equal(t, "docker.io", sourceRegistry("index.docker.io/a/b:v"))
+	assert.Equal(t, "quay.io", sourceRegistry("quay.io/a/b:v"))
+	assert.Equal(t, "localhost", sourceRegistry("localhost/a:v"))
+	assert.Equal(t, "localhost:5000", sourceRegistry("localhost:5000/a:v"))
+	assert.Equal(t, "myregistry:5000", sourceRegistry("myregistry:5000/a:v"))
+	assert.Equal(t, "[::1]:5000", sourceRegistry("[::1]:5000/a:v"))
+}
+
+func TestImageLocalhostRegistryMapping(t *testing.T) {
+
+	wh := mutationWH{
+		registryMapping: map[string]string{
+			"localhost:5000": "harbor.corp/local",
+		},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "localhost:5000/app:v1"},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "harbor.corp/local/app:v1", patches[0].Value)
+}
+
 func TestImagePullSecretNotPresent(t *testing.T) {
 	_ = logging.SetLogLevel(log, "debug")
 
@@ -554,8 +732,8 @@ func TestImagePullSecretWithAppendAndEmptySecret(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(patches))
 	assert.Equal(t, "add", patches[0].Op)
-	assert.Equal(t, "/spec/imagePullSecrets/0", patches[0].Path)
-	assert.Equal(t, []map[string]string{{"name": "random-pull-secret"}}, patches[0].Value)
+	assert.Equal(t, "/spec/imagePullSecrets/-", patches[0].Path)
+	assert.Equal(t, map[string]string{"name": "random-pull-secret"}, patches[0].Value)
 }
 
 func TestImagePullSecretWithAppendAndNoneExistingSecret(t *testing.T) {
@@ -623,8 +801,8 @@ func TestImagePullSecretAppendToExistingSecret(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(patches))
 	assert.Equal(t, "add", patches[0].Op)
-	assert.Equal(t, "/spec/imagePullSecrets/2", patches[0].Path)
-	assert.Equal(t, []map[string]string{{"name": "a-new-pull-secret"}}, patches[0].Value)
+	assert.Equal(t, "/spec/imagePullSecrets/-", patches[0].Path)
+	assert.Equal(t, map[string]string{"name": "a-new-pull-secret"}, patches[0].Value)
 }
 
 func TestMissingPullPolicy(t *testing.T) {
@@ -775,6 +953,125 @@ func TestInitContainers(t *testing.T) {
 	assert.Equal(t, corev1.PullAlways, patches[0].Value)
 }
 
+func TestEphemeralContainers(t *testing.T) {
+
+	wh := mutationWH{
+		registry:               "x.y",
+		imagePullSecret:        "s1",
+		forceImagePullPolicy:   true,
+		imagePullPolicyToForce: corev1.PullAlways,
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "x.y/a:v", ImagePullPolicy: corev1.PullAlways},
+			},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Image: "busybox:1.28"}},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnEphemeralContainers(pod, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(patches))
+	assert.Equal(t, "replace", patches[0].Op)
+	assert.Equal(t, "/spec/ephemeralContainers/0/image", patches[0].Path)
+	assert.Equal(t, "x.y/busybox:1.28", patches[0].Value)
+	assert.Equal(t, "add", patches[1].Op)
+	assert.Equal(t, "/spec/ephemeralContainers/0/imagePullPolicy", patches[1].Path)
+	assert.Equal(t, corev1.PullAlways, patches[1].Value)
+}
+
+func TestEphemeralContainersExisting(t *testing.T) {
+
+	wh := mutationWH{
+		registry:               "x.y",
+		forceImagePullPolicy:   true,
+		imagePullPolicyToForce: corev1.PullAlways,
+	}
+
+	existing := corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+		Name: "debugger-1", Image: "r.io/busybox", ImagePullPolicy: corev1.PullIfNotPresent,
+	}}
+	old := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers:          []corev1.Container{{Image: "x.y/a:v"}},
+			EphemeralContainers: []corev1.EphemeralContainer{existing},
+		},
+	}
+	pod := *old.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-2", Image: "busybox"},
+	})
+	raw, err := json.Marshal(pod)
+	assert.Nil(t, err)
+	oldRaw, err := json.Marshal(old)
+	assert.Nil(t, err)
+
+	// The existing ephemeral container is immutable, only the added one is mutated.
+	patches, err := wh.applyMutations(&admissionv1.AdmissionRequest{
+		Resource:    podResource,
+		SubResource: ephemeralContainersSubResource,
+		Operation:   admissionv1.Update,
+		Object:      runtime.RawExtension{Raw: raw},
+		OldObject:   runtime.RawExtension{Raw: oldRaw},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(patches))
+	assert.Equal(t, "/spec/ephemeralContainers/1/image", patches[0].Path)
+	assert.Equal(t, "x.y/busybox", patches[0].Value)
+	assert.Equal(t, "/spec/ephemeralContainers/1/imagePullPolicy", patches[1].Path)
+}
+
+func TestEphemeralContainersSubResource(t *testing.T) {
+
+	wh := mutationWH{
+		registry: "x.y",
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "a:v"},
+			},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Image: "busybox:1.28"}},
+			},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	assert.Nil(t, err)
+
+	patches, err := wh.applyMutations(&admissionv1.AdmissionRequest{
+		Resource:    podResource,
+		SubResource: ephemeralContainersSubResource,
+		Object:      runtime.RawExtension{Raw: raw},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "/spec/ephemeralContainers/0/image", patches[0].Path)
+	assert.Equal(t, "x.y/busybox:1.28", patches[0].Value)
+
+	patches, err = wh.applyMutations(&admissionv1.AdmissionRequest{
+		Resource: podResource,
+		Object:   runtime.RawExtension{Raw: raw},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "/spec/containers/0/image", patches[0].Path)
+	assert.Equal(t, "x.y/a:v", patches[0].Value)
+
+	patches, err = wh.applyMutations(&admissionv1.AdmissionRequest{
+		Resource:    podResource,
+		SubResource: "status",
+		Object:      runtime.RawExtension{Raw: raw},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
 func TestWithAllMutations(t *testing.T) {
 
 	wh := mutationWH{
@@ -859,3 +1156,124 @@ func TestWithDifferentStorageClass(t *testing.T) {
 	assert.Equal(t, "/spec/storageClassName", patches[0].Path)
 	assert.Equal(t, storageClass1, patches[0].Value)
 }
+
+func TestPodEphemeralVolumeStorageClass(t *testing.T) {
+
+	wh := mutationWH{
+		defaultStorageClass: storageClass1,
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				{Name: "config"},
+				{
+					Name: "scratch",
+					VolumeSource: corev1.VolumeSource{
+						Ephemeral: &corev1.EphemeralVolumeSource{
+							VolumeClaimTemplate: &corev1.PersistentVolumeClaimTemplate{
+								Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass2},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "replace", patches[0].Op)
+	assert.Equal(t, "/spec/volumes/1/ephemeral/volumeClaimTemplate/spec/storageClassName", patches[0].Path)
+	assert.Equal(t, storageClass1, patches[0].Value)
+
+	// The volumes of a pod are immutable, they are not mutated on update.
+	updated := pod
+	updated.Labels = map[string]string{"a": "b"}
+	patches, err = wh.applyMutations(updateRequest(t, updated, pod, podResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
+func TestStorageClassIfMissing(t *testing.T) {
+
+	wh := mutationWH{
+		defaultStorageClass: storageClass1,
+		storageClassPolicy:  storageClassIfMissing,
+	}
+
+	pvc := corev1.PersistentVolumeClaim{
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass2,
+		},
+	}
+
+	patches, err := wh.applyMutationOnPvc(pvc)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	patches, err = wh.applyMutationOnPvc(corev1.PersistentVolumeClaim{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "add", patches[0].Op)
+	assert.Equal(t, "/spec/storageClassName", patches[0].Path)
+	assert.Equal(t, storageClass1, patches[0].Value)
+}
+
+func TestStorageClassTranslate(t *testing.T) {
+
+	wh := mutationWH{
+		defaultStorageClass: storageClass1,
+		storageClassPolicy:  storageClassTranslate,
+		storageClassMapping: map[string]string{
+			"gp2":      "rook-ceph-block",
+			"standard": "ceph-fs",
+		},
+	}
+
+	gp2 := "gp2"
+	pvc := corev1.PersistentVolumeClaim{
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &gp2,
+		},
+	}
+
+	patches, err := wh.applyMutationOnPvc(pvc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "replace", patches[0].Op)
+	assert.Equal(t, "/spec/storageClassName", patches[0].Path)
+	assert.Equal(t, "rook-ceph-block", patches[0].Value)
+
+	// Storage classes not found in the mapping are kept.
+	pvc.Spec.StorageClassName = &storageClass2
+	patches, err = wh.applyMutationOnPvc(pvc)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	patches, err = wh.applyMutationOnPvc(corev1.PersistentVolumeClaim{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "add", patches[0].Op)
+	assert.Equal(t, storageClass1, patches[0].Value)
+}
+
+func TestIsStorageClassPolicyValid(t *testing.T) {
+	valid, policy := isStorageClassPolicyValid("IfMissing")
+	assert.True(t, valid)
+	assert.Equal(t, storageClassIfMissing, policy)
+	valid, policy = isStorageClassPolicyValid("Force")
+	assert.True(t, valid)
+	assert.Equal(t, storageClassForce, policy)
+	valid, policy = isStorageClassPolicyValid("Translate")
+	assert.True(t, valid)
+	assert.Equal(t, storageClassTranslate, policy)
+	// Unset, the default policy applies.
+	valid, policy = isStorageClassPolicyValid("")
+	assert.True(t, valid)
+	assert.Equal(t, storageClassForce, policy)
+
+	valid, _ = isStorageClassPolicyValid("force")
+	assert.False(t, valid)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// namespaceNameLabel is the label set by kubernetes on every namespace, with the name of the namespace.
+	namespaceNameLabel = "kubernetes.io/metadata.name"
+)
+
+// namespaceRegexps holds the compiled regular expressions of the namespace patterns, by pattern, such that
+// they are compiled once when the configuration is loaded, rather than on every admission request.
+var namespaceRegexps sync.Map
+
+// isExcludedNamespace checks if the given namespace is a excluded via the configuration.
+// A namespace is excluded if it matches one of the patterns, i.e. an exact name, a glob
+// such as preview-*, or a regular expression enclosed in slashes, such as /^ci-[0-9]+$/.
+func isExcludedNamespace(ns string, excludedNamespaces []string) bool {
+	for _, a := range excludedNamespaces {
+		if isRegexpPattern(a) {
+			if re, err := namespaceRegexp(a); err == nil && re.MatchString(ns) {
+				return true
+			}
+		} else if matched, err := path.Match(a, ns); a == ns || (err == nil && matched) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceRegexp returns the compiled regular expression of the given namespace pattern, compiling it on first use.
+func namespaceRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := namespaceRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+	if err != nil {
+		return nil, err
+	}
+	namespaceRegexps.Store(pattern, re)
+	return re, nil
+}
+
+// isRegexpPattern returns true if the namespace pattern is a regular expression, i.e. enclosed in slashes,
+// which cannot be mistaken for a namespace name or a glob, as namespace names cannot contain any slash.
+func isRegexpPattern(pattern string) bool {
+	return len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// isGlobPattern returns true if the namespace pattern contains any glob special character.
+func isGlobPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// compileNamespacePatterns compiles the regular expressions of the namespace patterns, and returns an error
+// if any of the patterns is not a valid glob or regular expression.
+func compileNamespacePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if isRegexpPattern(p) {
+			if _, err := namespaceRegexp(p); err != nil {
+				return fmt.Errorf("namespace pattern %s is not a valid regular expression: %v", p, err)
+			}
+		} else if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("namespace pattern %s is not a valid glob: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// parseNamespaceSelector parses the label selector of the excluded namespaces, nil meaning no selector.
+func parseNamespaceSelector(selector string) (labels.Selector, error) {
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("namespace selector %s is not valid: %v", selector, err)
+	}
+	return parsed, nil
+}
+
+// isExcludedFromMutation tells whether the mutations are not applied on the given namespace, either because
+// its name matches one of the excluded namespaces, or because its labels match the excluded namespace selector.
+// The labels are looked up from the namespace cache, a namespace missing from the cache is not excluded.
+func (wh *mutationWH) isExcludedFromMutation(ns string) bool {
+	if isExcludedNamespace(ns, wh.excludedNamespaces) {
+		return true
+	}
+	if ns == "" || wh.excludedNamespaceSelector == nil || wh.namespaces == nil {
+		return false
+	}
+
+	namespace, err := wh.namespaces.Get(ns)
+	if err != nil {
+		log.Debugf("Could not get the labels of namespace %s, assuming it is not excluded: %v", ns, err)
+		return false
+	}
+	return wh.excludedNamespaceSelector.Matches(labels.Set(namespace.Labels))
+}
+
+// isExcludedFromValidation tells whether the validation is not applied on the given namespace.
+func (wh *mutationWH) isExcludedFromValidation(ns string) bool {
+	return isExcludedNamespace(ns, wh.validationExcludedNamespaces)
+}
+
+// generateNamespaceSelector returns the namespaceSelector of the MutatingWebhookConfiguration matching the
+// namespaces which are not excluded, such that the API server does not even call the webhook for the others.
+// Globs, regular expressions and selectors with more than one requirement cannot be expressed as a
+// namespaceSelector, they are returned as warnings, and are still evaluated by the webhook itself.
+func generateNamespaceSelector(excludedNamespaces []string, excludedNamespaceSelector string) (*metav1.LabelSelector, []string, error) {
+
+	namespaceSelector := &metav1.LabelSelector{}
+	var warnings []string
+
+	var names []string
+	for _, p := range excludedNamespaces {
+		if isRegexpPattern(p) || isGlobPattern(p) {
+			warnings = append(warnings, fmt.Sprintf("namespace pattern %s cannot be expressed as a namespaceSelector", p))
+		} else {
+			names = append(names, p)
+		}
+	}
+	if len(names) > 0 {
+		namespaceSelector.MatchExpressions = append(namespaceSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      namespaceNameLabel,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   names,
+		})
+	}
+
+	selector, err := parseNamespaceSelector(excludedNamespaceSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	if selector != nil {
+		// Excluding the namespaces matching the selector means selecting the ones not matching it,
+		// which can only be expressed for a single requirement.
+		requirements, _ := selector.Requirements()
+		if len(requirements) != 1 {
+			warnings = append(warnings, fmt.Sprintf("namespace selector %s cannot be negated as a namespaceSelector", excludedNamespaceSelector))
+		} else if negated, ok := negateRequirement(requirements[0]); ok {
+			namespaceSelector.MatchExpressions = append(namespaceSelector.MatchExpressions, negated)
+		} else {
+			warnings = append(warnings, fmt.Sprintf("namespace selector %s cannot be negated as a namespaceSelector", excludedNamespaceSelector))
+		}
+	}
+
+	return namespaceSelector, warnings, nil
+}
+
+// negateRequirement returns the label selector requirement matching the labels the given requirement does not match.
+func negateRequirement(r labels.Requirement) (metav1.LabelSelectorRequirement, bool) {
+	negated := metav1.LabelSelectorRequirement{
+		Key:    r.Key(),
+		Values: r.Values().List(),
+	}
+	switch r.Operator() {
+	case selection.Equals, selection.DoubleEquals, selection.In:
+		negated.Operator = metav1.LabelSelectorOpNotIn
+	case selection.NotEquals, selection.NotIn:
+		negated.Operator = metav1.LabelSelectorOpIn
+	case selection.Exists:
+		negated.Operator = metav1.LabelSelectorOpDoesNotExist
+		negated.Values = nil
+	case selection.DoesNotExist:
+		negated.Operator = metav1.LabelSelectorOpExists
+		negated.Values = nil
+	default:
+		return metav1.LabelSelectorRequirement{}, false
+	}
+	return negated, true
+}
+
+// printMutatingNamespaceSelector prints the namespaceSelector generated from the configuration, which can be
+// copied in the MutatingWebhookConfiguration. The expressions which cannot be generated are printed as comments.
+func printMutatingNamespaceSelector(defaults webhookConfig, configFile string) error {
+	cfg := defaults
+	if configFile != "" {
+		content, err := os.ReadFile(configFile)
+		if err != nil {
+			return fmt.Errorf("could not read configuration file %s: %v", configFile, err)
+		}
+		if cfg, err = parseConfig(defaults, content); err != nil {
+			return err
+		}
+	}
+
+	namespaceSelector, warnings, err := generateNamespaceSelector(cfg.ExcludeNamespaces, cfg.ExcludeNamespaceSelector)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(map[string]*metav1.LabelSelector{"namespaceSelector": namespaceSelector})
+	if err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		fmt.Printf("# %s, it is evaluated by the webhook\n", w)
+	}
+	fmt.Print(string(out))
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func namespaceLister(t *testing.T, namespaces ...*corev1.Namespace) listersv1.NamespaceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		assert.Nil(t, indexer.Add(ns))
+	}
+	return listersv1.NewNamespaceLister(indexer)
+}
+
+func TestIsExcludedNamespaceGlob(t *testing.T) {
+	patterns := []string{"kube-system", "preview-*", "team-?"}
+	assert.True(t, isExcludedNamespace("kube-system", patterns))
+	assert.True(t, isExcludedNamespace("preview-1234", patterns))
+	assert.True(t, isExcludedNamespace("team-a", patterns))
+	assert.False(t, isExcludedNamespace("team-ab", patterns))
+	assert.False(t, isExcludedNamespace("production", patterns))
+}
+
+func TestIsExcludedNamespaceRegexp(t *testing.T) {
+	patterns := []string{"/^ci-[0-9]+$/"}
+	assert.True(t, isExcludedNamespace("ci-42", patterns))
+	assert.False(t, isExcludedNamespace("ci-pipeline", patterns))
+	assert.False(t, isExcludedNamespace("/^ci-[0-9]+$/", []string{"/"}))
+}
+
+func TestCompileNamespacePatterns(t *testing.T) {
+	assert.Nil(t, compileNamespacePatterns([]string{"kube-system", "preview-*", "/^qa-[0-9]+$/"}))
+	_, compiled := namespaceRegexps.Load("/^qa-[0-9]+$/")
+	assert.True(t, compiled)
+	assert.NotNil(t, compileNamespacePatterns([]string{"preview-["}))
+	assert.NotNil(t, compileNamespacePatterns([]string{"/^ci-(/"}))
+}
+
+func TestIsExcludedFromMutationSelector(t *testing.T) {
+	selector, err := parseNamespaceSelector("sqooba.io/webhook=disabled")
+	assert.Nil(t, err)
+
+	wh := &mutationWH{
+		excludedNamespaces:        []string{"kube-system"},
+		excludedNamespaceSelector: selector,
+		namespaces: namespaceLister(t,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Labels: map[string]string{"sqooba.io/webhook": "disabled"}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app", Labels: map[string]string{"sqooba.io/webhook": "enabled"}}},
+		),
+	}
+
+	assert.True(t, wh.isExcludedFromMutation("kube-system"))
+	assert.True(t, wh.isExcludedFromMutation("legacy"))
+	assert.False(t, wh.isExcludedFromMutation("app"))
+	// Namespaces missing from the cache are not excluded
+	assert.False(t, wh.isExcludedFromMutation("unknown"))
+}
+
+func TestNewMutationWHInvalidNamespaces(t *testing.T) {
+	_, err := newMutationWH(webhookConfig{ImagePullPolicyToForce: "Always", ExcludeNamespaces: []string{"preview-["}})
+	assert.NotNil(t, err)
+
+	_, err = newMutationWH(webhookConfig{ImagePullPolicyToForce: "Always", ExcludeNamespaceSelector: "a in (b"})
+	assert.NotNil(t, err)
+}
+
+func TestNamespaceSelectorWithoutCluster(t *testing.T) {
+	_, err := newWebhookServer(webhookConfig{
+		ImagePullPolicyToForce:   "Always",
+		ExcludeNamespaceSelector: "sqooba.io/webhook=disabled",
+	}, "", nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestGenerateNamespaceSelector(t *testing.T) {
+	selector, warnings, err := generateNamespaceSelector([]string{"kube-system", "kube-public", "preview-*"}, "sqooba.io/webhook=disabled")
+	assert.Nil(t, err)
+	assert.Equal(t, []metav1.LabelSelectorRequirement{
+		{Key: namespaceNameLabel, Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system", "kube-public"}},
+		{Key: "sqooba.io/webhook", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"disabled"}},
+	}, selector.MatchExpressions)
+	assert.Equal(t, 1, len(warnings))
+
+	selector, warnings, err = generateNamespaceSelector(nil, "!sqooba.io/legacy")
+	assert.Nil(t, err)
+	assert.Equal(t, []metav1.LabelSelectorRequirement{
+		{Key: "sqooba.io/legacy", Operator: metav1.LabelSelectorOpExists},
+	}, selector.MatchExpressions)
+	assert.Equal(t, 0, len(warnings))
+
+	selector, warnings, err = generateNamespaceSelector(nil, "a=b,c=d")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(selector.MatchExpressions))
+	assert.Equal(t, 1, len(warnings))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/distribution/reference"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// pullPolicyRule sets the pull policy of the containers whose image and namespace match all its conditions.
+// A condition which is not set matches all the containers.
+type pullPolicyRule struct {
+	// Tags are globs matching the tag of the image, latest if the image does not have any tag.
+	Tags []string `json:"tags,omitempty"`
+	// Digest matches the images referenced by digest if true, the others if false.
+	Digest *bool `json:"digest,omitempty"`
+	// Registries match the registry the image is pulled from, as IGNORED_REGISTRIES.
+	Registries []string `json:"registries,omitempty"`
+	// Namespaces are patterns matching the namespace of the pod, as EXCLUDE_NAMESPACES.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// PullPolicy is the pull policy to set.
+	PullPolicy corev1.PullPolicy `json:"pullPolicy"`
+}
+
+// pullPolicyRules is a list of pull policy rules, the first matching rule winning. They are decoded
+// by envconfig from their YAML or JSON representation, such as
+// [{"digest": true, "pullPolicy": "IfNotPresent"}, {"pullPolicy": "Always"}]
+type pullPolicyRules []pullPolicyRule
+
+// Decode implements the envconfig.Decoder interface.
+func (r *pullPolicyRules) Decode(value string) error {
+	var decoded pullPolicyRules
+	if err := yaml.UnmarshalStrict([]byte(value), &decoded); err != nil {
+		return fmt.Errorf("invalid pull policy rules: %v", err)
+	}
+	*r = decoded
+	return nil
+}
+
+// validate returns an error if any of the rules is not valid.
+func (r pullPolicyRules) validate() error {
+	for i, rule := range r {
+		if valid, _ := isPullPolicyValid(string(rule.PullPolicy)); !valid {
+			return fmt.Errorf("pull policy %s of rule %d is not valid", rule.PullPolicy, i)
+		}
+		for _, tag := range rule.Tags {
+			if _, err := path.Match(tag, ""); err != nil {
+				return fmt.Errorf("tag pattern %s of rule %d is not a valid glob: %v", tag, i, err)
+			}
+		}
+		if err := compileNamespacePatterns(rule.Namespaces); err != nil {
+			return fmt.Errorf("%v in rule %d", err, i)
+		}
+	}
+	return nil
+}
+
+// pullPolicyFor returns the pull policy of the first rule matching the given image, running in the given namespace,
+// and whether a rule matched.
+func (r pullPolicyRules) pullPolicyFor(image string, namespace string) (corev1.PullPolicy, bool) {
+	for _, rule := range r {
+		if rule.matches(image, namespace) {
+			return rule.PullPolicy, true
+		}
+	}
+	return "", false
+}
+
+// matches returns true if the given image, running in the given namespace, matches all the conditions of the rule.
+func (rule pullPolicyRule) matches(image string, namespace string) bool {
+
+	if len(rule.Namespaces) > 0 && !isExcludedNamespace(namespace, rule.Namespaces) {
+		return false
+	}
+	if len(rule.Registries) > 0 && !containsAnyRegistry(image, rule.Registries) && !contains(rule.Registries, sourceRegistry(image)) {
+		return false
+	}
+
+	tag, digested := latestTag, false
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		_, digested = named.(reference.Digested)
+		if tagged, ok := named.(reference.Tagged); ok {
+			tag = tagged.Tag()
+		} else if digested {
+			tag = ""
+		}
+	}
+
+	if rule.Digest != nil && *rule.Digest != digested {
+		return false
+	}
+	if len(rule.Tags) > 0 {
+		matched := false
+		for _, pattern := range rule.Tags {
+			if m, err := path.Match(pattern, tag); err == nil && m {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// contains returns true if the given value is one of the values.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testPullPolicyRules = `
+- namespaces: [local-dev]
+  pullPolicy: Never
+- digest: true
+  pullPolicy: IfNotPresent
+- tags: [latest, "*-SNAPSHOT"]
+  pullPolicy: Always
+- registries: [quay.io]
+  pullPolicy: IfNotPresent
+`
+
+func TestPullPolicyRulesDecode(t *testing.T) {
+	var rules pullPolicyRules
+	assert.Nil(t, rules.Decode(testPullPolicyRules))
+	assert.Equal(t, 4, len(rules))
+	assert.Equal(t, []string{"local-dev"}, rules[0].Namespaces)
+	assert.Equal(t, corev1.PullNever, rules[0].PullPolicy)
+	assert.True(t, *rules[1].Digest)
+	assert.Nil(t, rules.validate())
+
+	assert.Nil(t, rules.Decode(`[{"tags": ["latest"], "pullPolicy": "Always"}]`))
+	assert.Equal(t, 1, len(rules))
+
+	assert.NotNil(t, rules.Decode(`[{"tag": "latest"}]`))
+
+	assert.Nil(t, rules.Decode(`[{"pullPolicy": "Sometimes"}]`))
+	assert.NotNil(t, rules.validate())
+	assert.Nil(t, rules.Decode(`[{"tags": ["["], "pullPolicy": "Always"}]`))
+	assert.NotNil(t, rules.validate())
+}
+
+func TestPullPolicyFor(t *testing.T) {
+	var rules pullPolicyRules
+	assert.Nil(t, rules.Decode(testPullPolicyRules))
+
+	for _, c := range []struct {
+		image      string
+		namespace  string
+		pullPolicy corev1.PullPolicy
+		matched    bool
+	}{
+		{"a:v1", "local-dev", corev1.PullNever, true},
+		{"a@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "ns", corev1.PullIfNotPresent, true},
+		{"a:latest@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "ns", corev1.PullIfNotPresent, true},
+		{"a", "ns", corev1.PullAlways, true},
+		{"a:latest", "ns", corev1.PullAlways, true},
+		{"a:1.0-SNAPSHOT", "ns", corev1.PullAlways, true},
+		{"quay.io/a:v1", "ns", corev1.PullIfNotPresent, true},
+		{"quay.io/a:latest", "ns", corev1.PullAlways, true},
+		{"a:v1", "ns", "", false},
+	} {
+		pullPolicy, matched := rules.pullPolicyFor(c.image, c.namespace)
+		assert.Equal(t, c.pullPolicy, pullPolicy, c.image)
+		assert.Equal(t, c.matched, matched, c.image)
+	}
+}
+
+func TestPullPolicyRules(t *testing.T) {
+	wh := mutationWH{
+		registry:               "x.y",
+		forceImagePullPolicy:   true,
+		imagePullPolicyToForce: corev1.PullNever,
+	}
+	assert.Nil(t, wh.pullPolicyRules.Decode(`
+- tags: [latest]
+  pullPolicy: Always
+- registries: [x.y]
+  tags: [v1]
+  pullPolicy: IfNotPresent
+`))
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "a", ImagePullPolicy: corev1.PullAlways},
+				{Image: "b:v1", ImagePullPolicy: corev1.PullAlways},
+				{Image: "c:v2", ImagePullPolicy: corev1.PullIfNotPresent},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: "x.y/a"},
+		{Op: "replace", Path: "/spec/containers/1/image", Value: "x.y/b:v1"},
+		{Op: "replace", Path: "/spec/containers/2/image", Value: "x.y/c:v2"},
+		// the rules apply to the rewritten images, falling back to the pull policy to force.
+		{Op: "replace", Path: "/spec/containers/1/imagePullPolicy", Value: corev1.PullIfNotPresent},
+		{Op: "replace", Path: "/spec/containers/2/imagePullPolicy", Value: corev1.PullNever},
+	}, patches)
+
+	// Without forcing the pull policy, only the rules apply.
+	wh.forceImagePullPolicy = false
+	patches, err = wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(patches))
+}
+
+func TestParseConfigPullPolicyRules(t *testing.T) {
+	defaults := webhookConfig{}
+	assert.Nil(t, defaults.PullPolicyRules.Decode(`[{"pullPolicy": "Always"}]`))
+
+	cfg, err := parseConfig(defaults, []byte("pullPolicyRules:\n  - digest: true\n    pullPolicy: IfNotPresent\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(cfg.PullPolicyRules))
+	assert.Equal(t, corev1.PullIfNotPresent, cfg.PullPolicyRules[0].PullPolicy)
+	// the defaults are not altered.
+	assert.Equal(t, corev1.PullAlways, defaults.PullPolicyRules[0].PullPolicy)
+}
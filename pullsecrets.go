@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// missingPullSecretPolicy tells what to do with the pull secrets to inject which do not exist in the namespace of the pod.
+type missingPullSecretPolicy string
+
+const (
+	// missingPullSecretInject injects the pull secrets without checking they exist, the default policy.
+	missingPullSecretInject missingPullSecretPolicy = "Inject"
+	// missingPullSecretSkip does not inject the missing pull secrets.
+	missingPullSecretSkip missingPullSecretPolicy = "Skip"
+	// missingPullSecretWarn injects the missing pull secrets, and warns the client about them.
+	missingPullSecretWarn missingPullSecretPolicy = "Warn"
+	// missingPullSecretDeny denies the request.
+	missingPullSecretDeny missingPullSecretPolicy = "Deny"
+)
+
+func isMissingPullSecretPolicyValid(policy string) (bool, missingPullSecretPolicy) {
+	switch missingPullSecretPolicy(policy) {
+	case "":
+		return true, missingPullSecretInject
+	case missingPullSecretInject, missingPullSecretSkip, missingPullSecretWarn, missingPullSecretDeny:
+		return true, missingPullSecretPolicy(policy)
+	default:
+		return false, missingPullSecretInject
+	}
+}
+
+// checkPullSecrets looks up the given pull secrets in the secret cache, and applies the missing pull secret policy
+// on the ones which do not exist in the given namespace. The pull secrets the object already references are not
+// looked up, as they are not injected. It returns the pull secrets to inject, and the warning to return to the client,
+// if any, or a forbiddenError if the request is denied. Requests are never denied on update, the missing pull secrets
+// being skipped instead, as it would deny every update of the objects, such as the removal of their finalizers.
+func (wh *mutationWH) checkPullSecrets(namespace string, current []corev1.LocalObjectReference, secrets []string, update bool) ([]string, string, error) {
+	if wh.missingPullSecretPolicy == missingPullSecretInject || wh.missingPullSecretPolicy == "" || wh.secrets == nil {
+		return secrets, "", nil
+	}
+
+	var present, missing []string
+	for _, secret := range secrets {
+		if containsPullSecret(current, secret) {
+			present = append(present, secret)
+			continue
+		}
+		_, err := wh.secrets.ByNamespace(namespace).Get(secret)
+		if apierrors.IsNotFound(err) {
+			missing = append(missing, secret)
+			continue
+		}
+		if err != nil {
+			log.Errorf("Could not look up pull secret %s/%s, assuming it exists: %v", namespace, secret, err)
+		}
+		present = append(present, secret)
+	}
+	if len(missing) == 0 {
+		return secrets, "", nil
+	}
+
+	message := fmt.Sprintf("pull secret(s) %s not found in namespace %s", strings.Join(missing, ", "), namespace)
+	policy := wh.missingPullSecretPolicy
+	if policy == missingPullSecretDeny && update {
+		policy = missingPullSecretSkip
+	}
+	switch policy {
+	case missingPullSecretSkip:
+		log.Printf("The %s, not injecting them", message)
+		return present, "", nil
+	case missingPullSecretDeny:
+		return nil, "", &forbiddenError{message: fmt.Sprintf("The %s, create them and retry", message)}
+	default:
+		log.Printf("The %s, injecting them anyway", message)
+		return secrets, fmt.Sprintf("The %s, the images may fail to be pulled", message), nil
+	}
+}
+
+// containsPullSecret returns true if the given pull secret is referenced by the given pull secrets.
+func containsPullSecret(pullSecrets []corev1.LocalObjectReference, secret string) bool {
+	for _, s := range pullSecrets {
+		if s.Name == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// registryPullSecret returns the pull secret of the registry the given image is pulled from, and whether
+// the registry has a pull secret. Registries are matched as IGNORED_REGISTRIES, or against the registry
+// of the normalized image, such that docker.io matches the docker hub images. The longest registry wins,
+// such that a.b/team can have another pull secret than a.b.
+func (wh *mutationWH) registryPullSecret(image string) (string, bool) {
+	secret, matched := "", ""
+	source := sourceRegistry(image)
+	for registry, s := range wh.registryPullSecrets {
+		if (containsRegistry(image, registry) || source == registry) && len(registry) > len(matched) {
+			secret, matched = s, registry
+		}
+	}
+	return secret, matched != ""
+}
+
+// applyPullSecrets returns the patch operations injecting IMAGE_PULL_SECRET, if any, along with the pull secrets
+// needed by the given images, i.e. the pull secret of each registry of REGISTRY_PULL_SECRETS they are pulled from.
+// They are appended to the existing pull secrets of the pod spec, located at the given path, or replace them,
+// depending on IMAGE_PULL_SECRET_APPEND. The pull secrets which do not exist in the given namespace are handled
+// according to MISSING_PULL_SECRET_POLICY, whether the pod spec is updated or created.
+func (wh *mutationWH) applyPullSecrets(spec corev1.PodSpec, path string, namespace string, images []string, update bool) ([]patchOperation, error) {
+
+	var wanted []string
+	if wh.imagePullSecret != "" {
+		wanted = append(wanted, wh.imagePullSecret)
+	}
+	for _, image := range images {
+		if secret, ok := wh.registryPullSecret(image); ok && !contains(wanted, secret) {
+			wanted = append(wanted, secret)
+		}
+	}
+	wanted, warning, err := wh.checkPullSecrets(namespace, spec.ImagePullSecrets, wanted, update)
+	if err != nil {
+		return nil, err
+	}
+	log.Tracef("%s/spec/imagePullSecrets needed by images %s: %s", path, strings.Join(images, ", "), strings.Join(wanted, ", "))
+
+	return wh.pullSecretPatches(spec.ImagePullSecrets, path+"/spec/imagePullSecrets", wanted, warning), nil
+}
+
+// pullSecretPatches returns the patch operations injecting the wanted pull secrets into the given existing ones,
+// located at the given path, along with the given warning about the missing pull secrets, if any, or the
+// mutation warning otherwise. They are appended to the existing pull secrets or replace them,
+// depending on IMAGE_PULL_SECRET_APPEND.
+func (wh *mutationWH) pullSecretPatches(current []corev1.LocalObjectReference, path string, wanted []string, missingWarning string) []patchOperation {
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	var existing []string
+	for _, s := range current {
+		existing = append(existing, s.Name)
+	}
+
+	// if there are no existing pull secrets, append or replace is the same operation.
+	if current == nil {
+		return []patchOperation{{
+			Op:      "add",
+			Path:    path,
+			Value:   pullSecretReferences(wanted),
+			warning: wh.pullSecretWarning(missingWarning, wanted),
+		}}
+	}
+
+	if wh.appendImagePullSecret {
+		var appended []string
+		for _, secret := range wanted {
+			if !contains(existing, secret) {
+				appended = append(appended, secret)
+			}
+		}
+		var patches []patchOperation
+		for _, secret := range appended {
+			patches = append(patches, patchOperation{
+				Op:      "add",
+				Path:    path + "/-",
+				Value:   map[string]string{"name": secret},
+				warning: wh.pullSecretWarning(missingWarning, appended),
+			})
+		}
+		return patches
+	}
+
+	if strings.Join(existing, ",") == strings.Join(wanted, ",") {
+		return nil
+	}
+	return []patchOperation{{
+		Op:      "replace",
+		Path:    path,
+		Value:   pullSecretReferences(wanted),
+		warning: wh.pullSecretWarning(missingWarning, wanted),
+	}}
+}
+
+// pullSecretWarning returns the given warning about the missing pull secrets, if any, as it also tells
+// about their injection, or the mutation warning about the injection of the given pull secrets otherwise.
+func (wh *mutationWH) pullSecretWarning(missingWarning string, injected []string) string {
+	if missingWarning != "" {
+		return missingWarning
+	}
+	return wh.mutationWarning("pull secret(s) %s injected", strings.Join(injected, ", "))
+}
+
+// pullSecretReferences returns the value of the imagePullSecrets referencing the given secrets.
+func pullSecretReferences(secrets []string) []map[string]string {
+	references := make([]map[string]string, 0, len(secrets))
+	for _, s := range secrets {
+		references = append(references, map[string]string{"name": s})
+	}
+	return references
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// secretLister returns a lister of the metadata of the given secrets, as the one of the metadata informer.
+func secretLister(t *testing.T, secrets ...*corev1.Secret) cache.GenericLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, s := range secrets {
+		assert.Nil(t, indexer.Add(&metav1.PartialObjectMetadata{ObjectMeta: s.ObjectMeta}))
+	}
+	return cache.NewGenericLister(indexer, corev1.Resource("secrets"))
+}
+
+func TestRegistryPullSecret(t *testing.T) {
+	wh := mutationWH{
+		registryPullSecrets: map[string]string{
+			"harbor.corp":      "harbor",
+			"harbor.corp/team": "harbor-team",
+			"docker.io":        "dockerhub",
+		},
+	}
+
+	for _, c := range []struct {
+		image  string
+		secret string
+		ok     bool
+	}{
+		{"harbor.corp/a:v", "harbor", true},
+		{"harbor.corp/team/a:v", "harbor-team", true},
+		{"a:v", "dockerhub", true},
+		{"docker.io/library/a:v", "dockerhub", true},
+		{"quay.io/a:v", "", false},
+	} {
+		secret, ok := wh.registryPullSecret(c.image)
+		assert.Equal(t, c.secret, secret, c.image)
+		assert.Equal(t, c.ok, ok, c.image)
+	}
+}
+
+func TestRegistryPullSecrets(t *testing.T) {
+	wh := mutationWH{
+		registryMapping:     map[string]string{"docker.io": "harbor.corp/dockerhub", "quay.io": "quay.corp"},
+		registryPullSecrets: map[string]string{"harbor.corp": "harbor", "quay.corp": "quay", "gcr.io": "gcr"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Image: "quay.io/a:v"},
+			},
+			Containers: []corev1.Container{
+				{Image: "b:v"},
+				{Image: "c:v"},
+			},
+		},
+	}
+
+	// Only the secrets of the registries of the rewritten images are injected, once.
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(patches))
+	assert.Equal(t, patchOperation{
+		Op:    "add",
+		Path:  "/spec/imagePullSecrets",
+		Value: []map[string]string{{"name": "quay"}, {"name": "harbor"}},
+	}, patches[3])
+}
+
+func TestRegistryPullSecretsWithImagePullSecret(t *testing.T) {
+	wh := mutationWH{
+		imagePullSecret:     "global",
+		registryPullSecrets: map[string]string{"harbor.corp": "harbor"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "harbor.corp/a:v"},
+			},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "other"}},
+		},
+	}
+
+	// Replaced by default.
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{{
+		Op:    "replace",
+		Path:  "/spec/imagePullSecrets",
+		Value: []map[string]string{{"name": "global"}, {"name": "harbor"}},
+	}}, patches)
+
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "global"}, {Name: "harbor"}}
+	patches, err = wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	// Appended if missing.
+	wh.appendImagePullSecret = true
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "other"}, {Name: "harbor"}}
+	patches, err = wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{{
+		Op:    "add",
+		Path:  "/spec/imagePullSecrets/-",
+		Value: map[string]string{"name": "global"},
+	}}, patches)
+}
+
+func TestRegistryPullSecretsNotNeeded(t *testing.T) {
+	wh := mutationWH{
+		registryPullSecrets: map[string]string{"harbor.corp": "harbor"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "quay.io/a:v"},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
+func TestMissingPullSecretPolicy(t *testing.T) {
+	wh := mutationWH{
+		imagePullSecret: "harbor",
+		secrets: secretLister(t,
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "with-secret", Name: "harbor"}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "other"}},
+		),
+	}
+	pod := func(namespace string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Image: "a:v"}}},
+		}
+	}
+	injected := patchOperation{
+		Op:    "add",
+		Path:  "/spec/imagePullSecrets",
+		Value: []map[string]string{{"name": "harbor"}},
+	}
+
+	for _, policy := range []missingPullSecretPolicy{missingPullSecretSkip, missingPullSecretWarn, missingPullSecretDeny} {
+		wh.missingPullSecretPolicy = policy
+		patches, err := wh.applyMutationOnPod(pod("with-secret"))
+		assert.Nil(t, err, policy)
+		assert.Equal(t, []patchOperation{injected}, patches, policy)
+	}
+
+	wh.missingPullSecretPolicy = missingPullSecretSkip
+	patches, err := wh.applyMutationOnPod(pod("other"))
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+
+	wh.missingPullSecretPolicy = missingPullSecretWarn
+	patches, err = wh.applyMutationOnPod(pod("other"))
+	assert.Nil(t, err)
+	warned := injected
+	warned.warning = "The pull secret(s) harbor not found in namespace other, the images may fail to be pulled"
+	assert.Equal(t, []patchOperation{warned}, patches)
+
+	wh.missingPullSecretPolicy = missingPullSecretDeny
+	_, err = wh.applyMutationOnPod(pod("other"))
+	var forbidden *forbiddenError
+	assert.ErrorAs(t, err, &forbidden)
+
+	// The pods already referencing the missing pull secrets are not denied, as no pull secret is injected.
+	referencing := pod("other")
+	referencing.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "harbor"}}
+	patches, err = wh.applyMutationOnPod(referencing)
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+
+	// Nor are the pods updated, the missing pull secrets being skipped.
+	updated := pod("other")
+	updated.Labels = map[string]string{"a": "b"}
+	patches, err = wh.applyMutations(updateRequest(t, updated, pod("other"), podResource))
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+
+	// The secrets are not looked up with the default policy.
+	wh.missingPullSecretPolicy = missingPullSecretInject
+	patches, err = wh.applyMutationOnPod(pod("other"))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{injected}, patches)
+}
+
+func TestMissingRegistryPullSecrets(t *testing.T) {
+	wh := mutationWH{
+		registryPullSecrets:     map[string]string{"harbor.corp": "harbor", "quay.corp": "quay"},
+		missingPullSecretPolicy: missingPullSecretSkip,
+		secrets:                 secretLister(t, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "quay"}}),
+	}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Image: "harbor.corp/a:v"},
+			{Image: "quay.corp/b:v"},
+		}},
+	}
+
+	// Only the existing secrets are injected.
+	patches, err := wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{{
+		Op:    "add",
+		Path:  "/spec/imagePullSecrets",
+		Value: []map[string]string{{"name": "quay"}},
+	}}, patches)
+}
+
+func TestMissingPullSecretWarning(t *testing.T) {
+	wh := &mutationWH{
+		imagePullSecret:         "harbor",
+		missingPullSecretPolicy: missingPullSecretWarn,
+		secrets:                 secretLister(t),
+	}
+
+	raw, err := json.Marshal(corev1.Pod{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "a:v"}}},
+	})
+	assert.Nil(t, err)
+
+	response := postAdmissionReview(t, wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation), &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Resource:  podResource,
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	assert.True(t, response.Allowed)
+	assert.Equal(t, []string{"The pull secret(s) harbor not found in namespace ns, the images may fail to be pulled"}, response.Warnings)
+	assert.JSONEq(t, `[{"op":"add","path":"/spec/imagePullSecrets","value":[{"name":"harbor"}]}]`, string(response.Patch))
+}
+
+func TestMissingPullSecretPolicyWithoutCluster(t *testing.T) {
+	_, err := newWebhookServer(webhookConfig{
+		ImagePullPolicyToForce:  "Always",
+		MissingPullSecretPolicy: "Warn",
+	}, "", nil, nil)
+	assert.NotNil(t, err)
+
+	_, err = newMutationWH(webhookConfig{
+		ImagePullPolicyToForce:  "Always",
+		MissingPullSecretPolicy: "Sometimes",
+	})
+	assert.NotNil(t, err)
+	// Unset, the pull secrets are injected without being looked up.
+	wh, err := newMutationWH(webhookConfig{
+		ImagePullPolicyToForce: "Always",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, missingPullSecretInject, wh.missingPullSecretPolicy)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// replicatedFromAnnotation is set on the replicated secrets, with the namespace/name of their source secret.
+	replicatedFromAnnotation = annotationPrefix + "replicated-from"
+	// managedByLabel is set on the replicated secrets, such that they can be told apart from the secrets of the users.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	// managedByValue is the value of managedByLabel on the replicated secrets.
+	managedByValue = "k8s-mutate-image-and-policy-webhook"
+)
+
+// secretList is a list of secrets decoded by envconfig from a comma separated list of namespace/name,
+// such as "kube-system/harbor,kube-system/quay". The names must be unique, as the copies are named after them.
+type secretList []types.NamespacedName
+
+// Decode implements the envconfig.Decoder interface.
+func (l *secretList) Decode(value string) error {
+	var decoded secretList
+	for _, s := range strings.Split(value, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		parts := strings.Split(strings.TrimSpace(s), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid secret %q, expected namespace/name", s)
+		}
+		secret := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+		for _, d := range decoded {
+			if d.Name == secret.Name {
+				return fmt.Errorf("secrets %s and %s have the same name, their copies would overwrite each other", d, secret)
+			}
+		}
+		decoded = append(decoded, secret)
+	}
+	*l = decoded
+	return nil
+}
+
+// secretReplicator copies source secrets, such as the pull secrets injected by the webhook,
+// into all the namespaces which are not excluded, and keeps the copies in sync with their source.
+// The secrets of the users are never overwritten: only the copies labelled as managed by the webhook are updated.
+type secretReplicator struct {
+	client     kubernetes.Interface
+	sources    secretList
+	isExcluded func(namespace string) bool
+}
+
+// run reconciles the namespaces as soon as they are created, and all of them every interval,
+// such that the copies are kept in sync with their source, until the stop channel is closed.
+func (r *secretReplicator) run(interval time.Duration, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	added := make(chan string, 16)
+	factory := informers.NewSharedInformerFactory(r.client, 0)
+	informer := factory.Core().V1().Namespaces().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if ns, ok := obj.(*corev1.Namespace); ok {
+				select {
+				case added <- ns.Name:
+				case <-ctx.Done():
+				}
+			}
+		},
+	}); err != nil {
+		log.Errorf("Could not watch the namespaces to replicate the secrets into: %v", err)
+		return
+	}
+	factory.Start(ctx.Done())
+
+	// The informer notifies the existing namespaces on start as well: they are reconciled all together instead,
+	// such that the sources are got once, and their notifications are skipped.
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+	existing := map[string]bool{}
+	for _, ns := range informer.GetStore().ListKeys() {
+		existing[ns] = true
+	}
+	r.reconcileAll(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ns := <-added:
+			if existing[ns] {
+				delete(existing, ns)
+				continue
+			}
+			r.reconcileNamespace(ctx, ns, r.getSources(ctx))
+		case <-ticker.C:
+			r.reconcileAll(ctx)
+		}
+	}
+}
+
+// reconcileAll reconciles the copies of the source secrets in all the namespaces.
+func (r *secretReplicator) reconcileAll(ctx context.Context) {
+	namespaces, err := r.client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		log.Errorf("Could not list the namespaces to replicate the secrets into: %v", err)
+		return
+	}
+	sources := r.getSources(ctx)
+	for _, ns := range namespaces.Items {
+		r.reconcileNamespace(ctx, ns.Name, sources)
+	}
+}
+
+// getSources gets the source secrets, by namespace/name, a nil secret meaning that the source does not exist anymore.
+// The sources which could not be got are missing, such that their copies are left as they are until the next reconciliation.
+func (r *secretReplicator) getSources(ctx context.Context) map[types.NamespacedName]*corev1.Secret {
+	sources := map[types.NamespacedName]*corev1.Secret{}
+	for _, source := range r.sources {
+		secret, err := r.client.CoreV1().Secrets(source.Namespace).Get(ctx, source.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			log.Debugf("Source secret %s does not exist, deleting its copies", source)
+			sources[source] = nil
+			continue
+		}
+		if err != nil {
+			log.Errorf("Could not get the source secret %s: %v", source, err)
+			continue
+		}
+		sources[source] = secret
+	}
+	return sources
+}
+
+// reconcileNamespace copies the given source secrets into the given namespace, or deletes their copies
+// if the namespace is excluded or if the source does not exist anymore.
+func (r *secretReplicator) reconcileNamespace(ctx context.Context, namespace string, sources map[types.NamespacedName]*corev1.Secret) {
+	excluded := r.isExcluded(namespace)
+	if excluded {
+		log.Tracef("Namespace %s is excluded, not replicating the secrets into it", namespace)
+	}
+	for _, source := range r.sources {
+		secret, ok := sources[source]
+		if source.Namespace == namespace || !ok {
+			continue
+		}
+		var err error
+		if excluded || secret == nil {
+			err = r.deleteCopy(ctx, source, namespace)
+		} else {
+			err = r.replicate(ctx, secret, namespace)
+		}
+		if err != nil {
+			log.Errorf("Could not reconcile the copy of secret %s in namespace %s: %v", source, namespace, err)
+		}
+	}
+}
+
+// replicate creates or updates the copy of the given source secret in the given namespace.
+func (r *secretReplicator) replicate(ctx context.Context, secret *corev1.Secret, namespace string) error {
+
+	source := types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}
+	secrets := r.client.CoreV1().Secrets(namespace)
+	existing, err := secrets.Get(ctx, source.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		replicated := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        source.Name,
+				Namespace:   namespace,
+				Labels:      map[string]string{managedByLabel: managedByValue},
+				Annotations: map[string]string{replicatedFromAnnotation: source.String()},
+			},
+			Type: secret.Type,
+			Data: secret.Data,
+		}
+		if _, err := secrets.Create(ctx, replicated, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		log.Printf("Secret %s replicated into namespace %s", source, namespace)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if existing.Labels[managedByLabel] != managedByValue || existing.Annotations[replicatedFromAnnotation] != source.String() {
+		log.Debugf("Secret %s/%s is not a copy of %s, not overwriting it", namespace, source.Name, source)
+		return nil
+	}
+	if existing.Type == secret.Type && reflect.DeepEqual(existing.Data, secret.Data) {
+		return nil
+	}
+
+	// The type of a secret is immutable, it has to be recreated.
+	if existing.Type != secret.Type {
+		if err := secrets.Delete(ctx, source.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		return r.replicate(ctx, secret, namespace)
+	}
+
+	existing.Data = secret.Data
+	if _, err := secrets.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		if apierrors.IsConflict(err) {
+			log.Debugf("Secret %s/%s was updated concurrently, it is synchronized at the next reconciliation", namespace, source.Name)
+			return nil
+		}
+		return err
+	}
+	log.Printf("Secret %s updated in namespace %s", source, namespace)
+	return nil
+}
+
+// deleteCopy deletes the copy of the given source secret in the given namespace, if any.
+// The secrets of the users, which are not managed by the webhook, are never deleted.
+func (r *secretReplicator) deleteCopy(ctx context.Context, source types.NamespacedName, namespace string) error {
+	secrets := r.client.CoreV1().Secrets(namespace)
+	existing, err := secrets.Get(ctx, source.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Labels[managedByLabel] != managedByValue || existing.Annotations[replicatedFromAnnotation] != source.String() {
+		return nil
+	}
+
+	// The precondition avoids deleting a copy recreated concurrently, such as by another replica.
+	uid := existing.UID
+	if err := secrets.Delete(ctx, source.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}}); err != nil {
+		if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+	log.Printf("Secret %s deleted from namespace %s", source, namespace)
+	return nil
+}
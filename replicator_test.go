@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretListDecode(t *testing.T) {
+	var l secretList
+	assert.Nil(t, l.Decode("kube-system/harbor, kube-system/quay"))
+	assert.Equal(t, secretList{{Namespace: "kube-system", Name: "harbor"}, {Namespace: "kube-system", Name: "quay"}}, l)
+
+	assert.NotNil(t, l.Decode("harbor"))
+	assert.NotNil(t, l.Decode("a/b/c"))
+	assert.NotNil(t, l.Decode("/harbor"))
+	assert.NotNil(t, l.Decode("a/harbor,b/harbor"))
+}
+
+func newTestReplicator(objects ...*corev1.Namespace) (*secretReplicator, *fake.Clientset) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "harbor"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+	})
+	for _, ns := range append([]*corev1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}}}, objects...) {
+		_, _ = client.CoreV1().Namespaces().Create(context.Background(), ns, metav1.CreateOptions{})
+	}
+
+	wh := &mutationWH{excludedNamespaces: []string{"excluded-*"}}
+	return &secretReplicator{
+		client:     client,
+		sources:    secretList{{Namespace: "kube-system", Name: "harbor"}},
+		isExcluded: wh.isExcludedFromMutation,
+	}, client
+}
+
+func TestSecretReplicatorReconcile(t *testing.T) {
+	r, client := newTestReplicator(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "excluded-a"}},
+	)
+	ctx := context.Background()
+
+	r.reconcileAll(ctx)
+
+	replicated, err := client.CoreV1().Secrets("app").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.SecretTypeDockerConfigJson, replicated.Type)
+	assert.Equal(t, `{"auths":{}}`, string(replicated.Data[corev1.DockerConfigJsonKey]))
+	assert.Equal(t, managedByValue, replicated.Labels[managedByLabel])
+	assert.Equal(t, "kube-system/harbor", replicated.Annotations[replicatedFromAnnotation])
+
+	_, err = client.CoreV1().Secrets("excluded-a").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.NotNil(t, err)
+
+	// Kept in sync with the source.
+	source, _ := client.CoreV1().Secrets("kube-system").Get(ctx, "harbor", metav1.GetOptions{})
+	source.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{"harbor.corp":{}}}`)
+	_, err = client.CoreV1().Secrets("kube-system").Update(ctx, source, metav1.UpdateOptions{})
+	assert.Nil(t, err)
+
+	r.reconcileAll(ctx)
+	replicated, err = client.CoreV1().Secrets("app").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"auths":{"harbor.corp":{}}}`, string(replicated.Data[corev1.DockerConfigJsonKey]))
+}
+
+func TestSecretReplicatorDoesNotOverwriteUserSecrets(t *testing.T) {
+	r, client := newTestReplicator(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app"}})
+	ctx := context.Background()
+
+	_, err := client.CoreV1().Secrets("app").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "harbor"},
+		Data:       map[string][]byte{"mine": []byte("mine")},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+
+	r.reconcileAll(ctx)
+
+	secret, err := client.CoreV1().Secrets("app").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"mine": []byte("mine")}, secret.Data)
+
+	// Nor the copies of another source.
+	_, err = client.CoreV1().Secrets("other").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "other",
+			Name:        "harbor",
+			Labels:      map[string]string{managedByLabel: managedByValue},
+			Annotations: map[string]string{replicatedFromAnnotation: "team/harbor"},
+		},
+		Data: map[string][]byte{"team": []byte("team")},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+
+	r.reconcileNamespace(ctx, "other", r.getSources(ctx))
+
+	secret, err = client.CoreV1().Secrets("other").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"team": []byte("team")}, secret.Data)
+}
+
+func TestSecretReplicatorDeletesStaleCopies(t *testing.T) {
+	excluded := false
+	r, client := newTestReplicator(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}},
+	)
+	r.isExcluded = func(ns string) bool { return excluded && ns == "team" }
+	ctx := context.Background()
+
+	_, err := client.CoreV1().Secrets("app").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "quay"},
+		Data:       map[string][]byte{"mine": []byte("mine")},
+	}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	r.sources = append(r.sources, types.NamespacedName{Namespace: "kube-system", Name: "quay"})
+
+	r.reconcileAll(ctx)
+	_, err = client.CoreV1().Secrets("team").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// The copies are deleted from the namespaces which become excluded.
+	excluded = true
+	r.reconcileAll(ctx)
+	_, err = client.CoreV1().Secrets("team").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = client.CoreV1().Secrets("app").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// All the copies are deleted when the source is deleted, but not the secrets of the users.
+	assert.Nil(t, client.CoreV1().Secrets("kube-system").Delete(ctx, "harbor", metav1.DeleteOptions{}))
+	r.reconcileAll(ctx)
+	_, err = client.CoreV1().Secrets("app").Get(ctx, "harbor", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = client.CoreV1().Secrets("app").Get(ctx, "quay", metav1.GetOptions{})
+	assert.Nil(t, err)
+}
+
+func TestSecretReplicatorGetsSourcesOnce(t *testing.T) {
+	r, client := newTestReplicator(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "a"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "c"}},
+	)
+	client.ClearActions()
+
+	r.reconcileAll(context.Background())
+
+	sourceGets := 0
+	for _, action := range client.Actions() {
+		if action.Matches("get", "secrets") && action.GetNamespace() == "kube-system" {
+			sourceGets++
+		}
+	}
+	assert.Equal(t, 1, sourceGets)
+}
+
+func TestSecretReplicatorRun(t *testing.T) {
+	r, client := newTestReplicator(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "a"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+	)
+	ctx := context.Background()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.run(time.Hour, stop)
+
+	// The existing namespaces are reconciled together on start, getting the source once.
+	assert.Eventually(t, func() bool {
+		_, err := client.CoreV1().Secrets("a").Get(ctx, "harbor", metav1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	sourceGets := func() int {
+		gets := 0
+		for _, action := range client.Actions() {
+			if action.Matches("get", "secrets") && action.GetNamespace() == "kube-system" {
+				gets++
+			}
+		}
+		return gets
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, sourceGets())
+
+	// Namespaces are reconciled as soon as they are created.
+	_, err := client.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "new"}}, metav1.CreateOptions{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := client.CoreV1().Secrets("new").Get(ctx, "harbor", metav1.GetOptions{})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -2,12 +2,22 @@ package main
 
 import (
 	"net/http"
-
-	"github.com/sqooba/go-common/healthchecks"
 )
 
 // routes define all the routes of the http multiplexer
-func (wh *mutationWH) routes(mux *http.ServeMux, env envConfig) {
-	mux.Handle("/mutate", wh.admitFuncHandler(wh.applyMutations))
-	mux.Handle(healthchecks.HealthCheckPath, healthchecks.AlwaysOkHealthcheckFuncHandler())
+func (s *webhookServer) routes(mux *http.ServeMux) {
+	mux.Handle("/mutate", s.currentHandler(func(wh *mutationWH) http.Handler {
+		return wh.admitFuncHandler(wh.applyMutations, wh.isExcludedFromMutation)
+	}))
+	mux.Handle("/validate", s.currentHandler(func(wh *mutationWH) http.Handler {
+		return wh.admitFuncHandler(wh.validateImages, wh.isExcludedFromValidation)
+	}))
+}
+
+// currentHandler returns a http.Handler serving each request with the handler
+// of the mutationWH which is current when the request starts.
+func (s *webhookServer) currentHandler(handler func(wh *mutationWH) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(s.current.Load()).ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	serviceAccountResource = metav1.GroupVersionResource{Version: "v1", Resource: "serviceaccounts"}
+)
+
+// pullSecretTarget tells which objects the pull secrets are injected into.
+type pullSecretTarget string
+
+const (
+	// pullSecretTargetPod injects the pull secrets into each pod, the default target.
+	pullSecretTargetPod pullSecretTarget = "Pod"
+	// pullSecretTargetServiceAccount injects the pull secrets into the service accounts,
+	// the pods inheriting the pull secrets of their service account.
+	pullSecretTargetServiceAccount pullSecretTarget = "ServiceAccount"
+)
+
+func isPullSecretTargetValid(target string) (bool, pullSecretTarget) {
+	switch pullSecretTarget(target) {
+	case "":
+		return true, pullSecretTargetPod
+	case pullSecretTargetPod, pullSecretTargetServiceAccount:
+		return true, pullSecretTarget(target)
+	default:
+		return false, pullSecretTargetPod
+	}
+}
+
+// injectsPullSecretsIntoPods returns true if the pull secrets are injected into the pods,
+// false if they are injected into the service accounts.
+func (wh *mutationWH) injectsPullSecretsIntoPods() bool {
+	return wh.pullSecretTarget != pullSecretTargetServiceAccount
+}
+
+// applyMutationOnServiceAccount gets the deserialized service account and returns the patch operations
+// injecting the pull secrets into it, if they are injected into the service accounts, or an error
+// if something went wrong. As the images of its pods are not known, the service account gets
+// IMAGE_PULL_SECRET along with the pull secrets of all the REGISTRY_PULL_SECRETS.
+func (wh *mutationWH) applyMutationOnServiceAccount(serviceAccount corev1.ServiceAccount, operation admissionv1.Operation) ([]patchOperation, error) {
+
+	if wh.injectsPullSecretsIntoPods() {
+		log.Debugf("Pull secrets are injected into the pods, skipping service account %s/%s", serviceAccount.Namespace, serviceAccount.Name)
+		return nil, nil
+	}
+
+	options := wh.mutationOptions(serviceAccount.ObjectMeta)
+	if options.skip || options.skipPullSecret {
+		log.Debugf("Skipping the mutations of service account %s/%s", serviceAccount.Namespace, serviceAccount.Name)
+		return nil, nil
+	}
+
+	wanted, warning, err := wh.checkPullSecrets(serviceAccount.Namespace, serviceAccount.ImagePullSecrets,
+		wh.serviceAccountPullSecrets(), operation == admissionv1.Update)
+	if err != nil {
+		return nil, err
+	}
+
+	patches := wh.pullSecretPatches(serviceAccount.ImagePullSecrets, "/imagePullSecrets", wanted, warning)
+	log.Debugf("Patch applied: %v", patches)
+
+	return patches, nil
+}
+
+// serviceAccountPullSecrets returns the pull secrets injected into the service accounts, i.e. IMAGE_PULL_SECRET,
+// if any, followed by the pull secrets of the REGISTRY_PULL_SECRETS, sorted such that the patches are stable.
+func (wh *mutationWH) serviceAccountPullSecrets() []string {
+	var registrySecrets []string
+	for _, secret := range wh.registryPullSecrets {
+		if secret != wh.imagePullSecret && !contains(registrySecrets, secret) {
+			registrySecrets = append(registrySecrets, secret)
+		}
+	}
+	sort.Strings(registrySecrets)
+
+	if wh.imagePullSecret == "" {
+		return registrySecrets
+	}
+	return append([]string{wh.imagePullSecret}, registrySecrets...)
+}
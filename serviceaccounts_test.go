@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceAccountNotMutatedByDefault(t *testing.T) {
+	wh := mutationWH{
+		imagePullSecret: "harbor",
+	}
+
+	serviceAccount := corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "ns"}}
+	patches, err := wh.applyMutations(workloadRequest(t, serviceAccount, serviceAccountResource))
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+}
+
+func TestServiceAccountPullSecrets(t *testing.T) {
+	wh := mutationWH{
+		imagePullSecret:     "harbor",
+		registryPullSecrets: map[string]string{"quay.corp": "quay", "gcr.io": "gcr", "harbor.corp": "harbor"},
+		pullSecretTarget:    pullSecretTargetServiceAccount,
+	}
+
+	serviceAccount := corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "ns"}}
+	patches, err := wh.applyMutations(workloadRequest(t, serviceAccount, serviceAccountResource))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{{
+		Op:    "add",
+		Path:  "/imagePullSecrets",
+		Value: []map[string]string{{"name": "harbor"}, {"name": "gcr"}, {"name": "quay"}},
+	}}, patches)
+
+	// The pods inherit the pull secrets of their service account.
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Image: "quay.corp/a:v"}},
+		},
+	}
+	patches, err = wh.applyMutationOnPod(pod)
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+}
+
+func TestServiceAccountExistingPullSecrets(t *testing.T) {
+	wh := mutationWH{
+		imagePullSecret:  "harbor",
+		pullSecretTarget: pullSecretTargetServiceAccount,
+	}
+
+	serviceAccount := corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "mine"}},
+	}
+
+	patches, err := wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Create)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{{
+		Op:    "replace",
+		Path:  "/imagePullSecrets",
+		Value: []map[string]string{{"name": "harbor"}},
+	}}, patches)
+
+	wh.appendImagePullSecret = true
+	patches, err = wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Create)
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{{
+		Op:    "add",
+		Path:  "/imagePullSecrets/-",
+		Value: map[string]string{"name": "harbor"},
+	}}, patches)
+
+	// Already injected, nothing to do.
+	serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, corev1.LocalObjectReference{Name: "harbor"})
+	patches, err = wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Create)
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+}
+
+func TestServiceAccountSkipAnnotation(t *testing.T) {
+	wh := mutationWH{
+		imagePullSecret:  "harbor",
+		pullSecretTarget: pullSecretTargetServiceAccount,
+		optOutNamespaces: []string{"team-*"},
+	}
+
+	serviceAccount := corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app",
+		Namespace:   "team-a",
+		Annotations: map[string]string{skipPullSecretAnnotation: "true"},
+	}}
+	patches, err := wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Create)
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+
+	// Not allowed to opt out.
+	serviceAccount.Namespace = "production"
+	patches, err = wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Create)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+}
+
+func TestServiceAccountMissingPullSecret(t *testing.T) {
+	wh := mutationWH{
+		imagePullSecret:         "harbor",
+		pullSecretTarget:        pullSecretTargetServiceAccount,
+		missingPullSecretPolicy: missingPullSecretDeny,
+		secrets:                 secretLister(t),
+	}
+
+	serviceAccount := corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "ns"}}
+	_, err := wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Create)
+	var forbidden *forbiddenError
+	assert.ErrorAs(t, err, &forbidden)
+
+	// The service accounts are still updatable, the missing pull secrets being skipped.
+	patches, err := wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Update)
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+
+	// The pull secrets already referenced are not looked up.
+	serviceAccount.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "harbor"}}
+	patches, err = wh.applyMutationOnServiceAccount(serviceAccount, admissionv1.Create)
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+}
+
+func TestPullSecretTargetConfig(t *testing.T) {
+	cfg := webhookConfig{
+		ImagePullPolicyToForce: "Always",
+		PullSecretTarget:       "ServiceAccount",
+	}
+	wh, err := newMutationWH(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, pullSecretTargetServiceAccount, wh.pullSecretTarget)
+
+	// Unset, the pull secrets are injected into the pods.
+	cfg.PullSecretTarget = ""
+	wh, err = newMutationWH(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, pullSecretTargetPod, wh.pullSecretTarget)
+
+	cfg.PullSecretTarget = "Node"
+	_, err = newMutationWH(cfg)
+	assert.NotNil(t, err)
+}
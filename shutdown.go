@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// shutdownOnSignal waits for a signal, then flips the readiness to false, waits the given delay, such that
+// the API server and the load balancers stop routing the admission requests to this replica, and finally
+// shuts the server down, draining the in-flight requests until the given timeout.
+func shutdownOnSignal(server *http.Server, health *healthServer, signals <-chan os.Signal, delay time.Duration, timeout time.Duration) error {
+	sig := <-signals
+	log.Printf("Received %s, shutting down in %s", sig, delay)
+	health.setReadinessCheck("shutdown", func() error {
+		return errors.New("the webhook is shutting down")
+	})
+	time.Sleep(delay)
+
+	log.Printf("Shutting down, draining the in-flight requests for up to %s", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownOnSignal(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			_, _ = w.Write([]byte("done"))
+		}),
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+
+	// An in-flight request.
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-started
+
+	h := &healthServer{}
+	h.setReadinessCheck("config", func() error { return nil })
+	signals := make(chan os.Signal, 1)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- shutdownOnSignal(server, h, signals, 50*time.Millisecond, time.Second) }()
+	signals <- syscall.SIGTERM
+
+	// Not ready during the delay, while still serving.
+	assert.Eventually(t, func() bool { return len(h.ready()) > 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"shutdown: the webhook is shutting down"}, h.ready())
+
+	// The in-flight request is drained.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	assert.Equal(t, "done", <-responses)
+	assert.Nil(t, <-shutdown)
+	assert.Equal(t, http.ErrServerClosed, <-served)
+}
+
+func TestShutdownOnSignalTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}),
+	}
+	go func() { _ = server.Serve(listener) }()
+	go func() {
+		if resp, err := http.Get("http://" + listener.Addr().String()); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	// The request is not drained before the deadline.
+	err = shutdownOnSignal(server, &healthServer{}, signals, 0, 50*time.Millisecond)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+const (
+	// latestTag is the tag of the images which do not specify any tag.
+	latestTag = "latest"
+)
+
+// latestTagPolicy tells what to do with the images using the latest tag, explicitly or not.
+type latestTagPolicy string
+
+const (
+	// latestTagAllow leaves the images as is, the default policy.
+	latestTagAllow latestTagPolicy = "Allow"
+	// latestTagDeny denies the pods running such images.
+	latestTagDeny latestTagPolicy = "Deny"
+	// latestTagRewrite replaces the tag of such images by the default tag.
+	latestTagRewrite latestTagPolicy = "Rewrite"
+)
+
+func isLatestTagPolicyValid(policy string) (bool, latestTagPolicy) {
+	switch latestTagPolicy(policy) {
+	case "":
+		return true, latestTagAllow
+	case latestTagAllow, latestTagDeny, latestTagRewrite:
+		return true, latestTagPolicy(policy)
+	default:
+		return false, latestTagAllow
+	}
+}
+
+// isTagValid returns true if the given tag is a valid image tag.
+func isTagValid(tag string) bool {
+	named, err := reference.ParseNormalizedNamed("image")
+	if err != nil {
+		return false
+	}
+	_, err = reference.WithTag(named, tag)
+	return err == nil
+}
+
+// latestTagPolicyFor returns the latest tag policy applying to the given namespace,
+// i.e. Allow in the namespaces allowed to use the latest tag, the configured policy otherwise.
+func (wh *mutationWH) latestTagPolicyFor(namespace string) latestTagPolicy {
+	if isExcludedNamespace(namespace, wh.latestTagAllowedNamespaces) {
+		return latestTagAllow
+	}
+	return wh.latestTagPolicy
+}
+
+// isLatestImage returns true if the image uses the latest tag, explicitly or not.
+// Images referenced by digest are immutable, hence never considered as latest.
+func isLatestImage(image string) bool {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return false
+	}
+	tagged, ok := named.(reference.Tagged)
+	return !ok || tagged.Tag() == latestTag
+}
+
+// applyLatestTagPolicy returns the image of the given container, with its tag replaced by the default tag
+// if it uses the latest tag and the policy is Rewrite, and whether it has been rewritten.
+// A description of the violation is returned instead if the policy is Deny.
+func (wh *mutationWH) applyLatestTagPolicy(container string, image string, policy latestTagPolicy) (string, bool, string) {
+	if policy == latestTagAllow || policy == "" || !isLatestImage(image) {
+		return image, false, ""
+	}
+
+	if policy == latestTagDeny {
+		return image, false, fmt.Sprintf("container %q image %q", container, image)
+	}
+	return strings.TrimSuffix(image, ":"+latestTag) + ":" + wh.defaultTag, true, ""
+}
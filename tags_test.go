@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsLatestImage(t *testing.T) {
+	assert.True(t, isLatestImage("a"))
+	assert.True(t, isLatestImage("a:latest"))
+	assert.True(t, isLatestImage("localhost:5000/a"))
+	assert.True(t, isLatestImage("a.b/c/d:latest"))
+	assert.False(t, isLatestImage("a:v1"))
+	assert.False(t, isLatestImage("localhost:5000/a:v1"))
+	assert.False(t, isLatestImage("a@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"))
+	assert.False(t, isLatestImage("a:latest@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"))
+}
+
+func latestPod(namespace string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "init", Image: "a"},
+			},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "localhost:5000/b:latest"},
+				{Name: "sidecar", Image: "c:v1"},
+			},
+		},
+	}
+}
+
+func TestLatestTagDeny(t *testing.T) {
+	wh := mutationWH{
+		registry:                   "x.y",
+		latestTagPolicy:            latestTagDeny,
+		latestTagAllowedNamespaces: []string{"dev-*"},
+	}
+
+	_, err := wh.applyMutationOnPod(latestPod("production"))
+	assert.Equal(t, &forbiddenError{
+		message: `container "init" image "a", container "app" image "localhost:5000/b:latest" use the latest tag, set an explicit tag`,
+	}, err)
+
+	patches, err := wh.applyMutationOnPod(latestPod("dev-alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(patches))
+}
+
+func TestLatestTagDenyOnUpdate(t *testing.T) {
+	wh := mutationWH{
+		latestTagPolicy: latestTagDeny,
+	}
+
+	// The pods created before the policy can still be updated, such as to remove their finalizers.
+	pod := latestPod("production")
+	updated := latestPod("production")
+	updated.Finalizers = []string{"example.com/cleanup"}
+	patches, err := wh.applyMutations(updateRequest(t, updated, pod, podResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	// But not to use another image with the latest tag.
+	updated.Spec.Containers[1].Image = "c"
+	_, err = wh.applyMutations(updateRequest(t, updated, pod, podResource))
+	assert.Equal(t, &forbiddenError{message: `container "sidecar" image "c" use the latest tag, set an explicit tag`}, err)
+
+	// Nor are their images rewritten.
+	wh.latestTagPolicy = latestTagRewrite
+	wh.defaultTag = "stable"
+	patches, err = wh.applyMutations(updateRequest(t, updated, pod, podResource))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/1/image", Value: "c:stable"},
+	}, patches)
+}
+
+func TestLatestTagRewrite(t *testing.T) {
+	wh := mutationWH{
+		latestTagPolicy:            latestTagRewrite,
+		defaultTag:                 "stable",
+		latestTagAllowedNamespaces: []string{"dev-*"},
+	}
+
+	patches, err := wh.applyMutationOnPod(latestPod("production"))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/initContainers/0/image", Value: "a:stable"},
+		{Op: "replace", Path: "/spec/containers/0/image", Value: "localhost:5000/b:stable"},
+	}, patches)
+
+	patches, err = wh.applyMutationOnPod(latestPod("dev-alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+
+	// Retagged, then rewritten to the registry.
+	wh.registry = "x.y"
+	patches, err = wh.applyMutationOnPod(latestPod("production"))
+	assert.Nil(t, err)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/initContainers/0/image", Value: "x.y/a:stable"},
+		{Op: "replace", Path: "/spec/containers/0/image", Value: "x.y/b:stable"},
+		{Op: "replace", Path: "/spec/containers/1/image", Value: "x.y/c:v1"},
+	}, patches)
+}
+
+func TestNewMutationWHLatestTag(t *testing.T) {
+	cfg := webhookConfig{ImagePullPolicyToForce: "Always", LatestTagPolicy: "Rewrite"}
+
+	_, err := newMutationWH(cfg)
+	assert.NotNil(t, err)
+
+	cfg.DefaultTag = "not a tag"
+	_, err = newMutationWH(cfg)
+	assert.NotNil(t, err)
+
+	cfg.DefaultTag = "stable"
+	wh, err := newMutationWH(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, latestTagRewrite, wh.latestTagPolicy)
+
+	// Unset, the default policy applies.
+	cfg.LatestTagPolicy = ""
+	wh, err = newMutationWH(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, latestTagAllow, wh.latestTagPolicy)
+
+	cfg.LatestTagPolicy = "Sometimes"
+	_, err = newMutationWH(cfg)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyPairReloader serves the key pair of the given files, reloaded when their content changes, such as when
+// cert-manager renews the secret they are mounted from, without restarting the webhook.
+type keyPairReloader struct {
+	certFile string
+	keyFile  string
+
+	certificate atomic.Pointer[tls.Certificate]
+
+	// reloadMutex prevents concurrent reloads, and protects the content of the last loaded files.
+	reloadMutex sync.Mutex
+	lastCert    []byte
+	lastKey     []byte
+}
+
+// newKeyPairReloader returns a keyPairReloader serving the key pair of the given files,
+// which is loaded once, an error being returned if it is not valid.
+func newKeyPairReloader(certFile string, keyFile string) (*keyPairReloader, error) {
+	r := &keyPairReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// getCertificate returns the current key pair, to be used as tls.Config.GetCertificate.
+func (r *keyPairReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := r.certificate.Load(); c != nil {
+		return c, nil
+	}
+	return nil, errors.New("the serving certificate has not been loaded yet")
+}
+
+// reload reads the files and swaps the current key pair if their content changed since the last reload.
+// It returns whether the key pair has been swapped. If the key pair is not valid, for instance while
+// the files are being updated, an error is returned and the current key pair is kept.
+func (r *keyPairReloader) reload() (bool, error) {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	cert, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read certificate file %s: %v", r.certFile, err)
+	}
+	key, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read key file %s: %v", r.keyFile, err)
+	}
+	if r.certificate.Load() != nil && bytes.Equal(cert, r.lastCert) && bytes.Equal(key, r.lastKey) {
+		return false, nil
+	}
+
+	certificate, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return false, fmt.Errorf("key pair %s, %s is not valid: %v", r.certFile, r.keyFile, err)
+	}
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return false, fmt.Errorf("certificate %s is not valid: %v", r.certFile, err)
+	}
+
+	r.certificate.Store(&certificate)
+	recordCertificateExpiry(certificate.Leaf.NotAfter)
+	r.lastCert, r.lastKey = cert, key
+	return true, nil
+}
+
+// watch polls the files every interval, and reloads them when their content changes, until the stop channel
+// is closed.
+func (r *keyPairReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	pollEvery(interval, stop, func() {
+		if reloaded, err := r.reload(); err != nil {
+			certificateReloads.WithLabelValues("error").Inc()
+			log.Errorf("Could not reload the serving certificate, keeping the previous one: %v", err)
+		} else if reloaded {
+			certificateReloads.WithLabelValues("success").Inc()
+			log.Printf("Serving certificate reloaded from %s, valid until %s", r.certFile, r.certificate.Load().Leaf.NotAfter)
+		}
+	})
+}
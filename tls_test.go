@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKeyPair writes a new key pair, signed by a new CA, into the given files.
+func writeKeyPair(t *testing.T, certFile string, keyFile string) {
+	b := &certBootstrapper{dnsNames: []string{testDNSName}, validity: time.Hour, now: time.Now}
+	data, err := b.generate(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(certFile, data[tlsCertSecretKey], 0600))
+	assert.Nil(t, os.WriteFile(keyFile, data[tlsKeySecretKey], 0600))
+}
+
+func TestKeyPairReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	_, err := newKeyPairReloader(certFile, keyFile)
+	assert.NotNil(t, err)
+
+	writeKeyPair(t, certFile, keyFile)
+	r, err := newKeyPairReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	initial, err := r.getCertificate(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testDNSName}, initial.Leaf.DNSNames)
+
+	reloaded, err := r.reload()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+
+	// Renewed, the new key pair is served.
+	writeKeyPair(t, certFile, keyFile)
+	reloaded, err = r.reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	renewed, _ := r.getCertificate(nil)
+	assert.NotEqual(t, initial.Certificate, renewed.Certificate)
+
+	// Half updated, the previous key pair is kept.
+	key, err := os.ReadFile(keyFile)
+	assert.Nil(t, err)
+	writeKeyPair(t, certFile, keyFile)
+	assert.Nil(t, os.WriteFile(keyFile, key, 0600))
+	_, err = r.reload()
+	assert.NotNil(t, err)
+	served, _ := r.getCertificate(nil)
+	assert.Same(t, renewed, served)
+}
+
+func TestKeyPairReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile)
+
+	r, err := newKeyPairReloader(certFile, keyFile)
+	assert.Nil(t, err)
+	initial, _ := r.getCertificate(nil)
+	reloads := testutil.ToFloat64(certificateReloads.WithLabelValues("success"))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.watch(10*time.Millisecond, stop)
+
+	writeKeyPair(t, certFile, keyFile)
+	assert.Eventually(t, func() bool {
+		c, _ := r.getCertificate(nil)
+		return c != initial
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(certificateReloads.WithLabelValues("success")) == reloads+1
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// validateImages implements the logic of our validating admission controller webhook.
+// It denies the pods running an image which is not pulled from an allowed registry, such that pods
+// bypassing the mutating webhook, for instance via namespace exclusions or webhook ordering,
+// still cannot run foreign images. It never returns any patch operation.
+func (wh *mutationWH) validateImages(req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+
+	if req.Resource != podResource {
+		log.Printf("Got an unexpected resource %s, don't know what to do with...", req.Resource)
+		return nil, nil
+	}
+
+	// Parse the Pod object, which is also the object of the pods/ephemeralcontainers subresource.
+	raw := req.Object.Raw
+	pod := corev1.Pod{}
+	if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
+		return nil, fmt.Errorf("could not deserialize pod object: %v", err)
+	}
+
+	return nil, wh.validatePod(pod)
+}
+
+// validatePod returns a forbiddenError naming all the containers of the pod running
+// an image which is not pulled from an allowed registry, or nil if all the images are allowed.
+func (wh *mutationWH) validatePod(pod corev1.Pod) error {
+
+	allowedRegistries := wh.allowedRegistries
+	if len(allowedRegistries) == 0 {
+		// default to the registries the mutating webhook rewrites images to, or ignores.
+		allowedRegistries = wh.untouchedRegistries()
+	}
+	if len(allowedRegistries) == 0 {
+		log.Debugf("No allowed registries are configured, all images are allowed")
+		return nil
+	}
+
+	var violations []string
+	check := func(name string, image string) {
+		if !containsAnyRegistry(image, allowedRegistries) && !contains(allowedRegistries, sourceRegistry(image)) {
+			violations = append(violations, fmt.Sprintf("container %q image %q", name, image))
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		check(c.Name, c.Image)
+	}
+	for _, c := range pod.Spec.Containers {
+		check(c.Name, c.Image)
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		check(c.Name, c.Image)
+	}
+
+	if len(violations) > 0 {
+		return &forbiddenError{message: fmt.Sprintf("%s not pulled from an allowed registry (%s)",
+			strings.Join(violations, ", "), strings.Join(allowedRegistries, ", "))}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidatePodAllowedRegistries(t *testing.T) {
+
+	wh := mutationWH{
+		allowedRegistries: []string{"harbor.corp", "docker.sqooba.io/public"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "init", Image: "harbor.corp/a:v"},
+			},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "docker.sqooba.io/public/b:v"},
+			},
+		},
+	}
+
+	assert.Nil(t, wh.validatePod(pod))
+}
+
+func TestValidatePodImplicitRegistry(t *testing.T) {
+
+	wh := mutationWH{
+		allowedRegistries: []string{"docker.io"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx:1.25"},
+				{Name: "sidecar", Image: "bitnami/redis:7"},
+				{Name: "proxy", Image: "docker.io/library/envoy:v1"},
+			},
+		},
+	}
+
+	assert.Nil(t, wh.validatePod(pod))
+}
+
+func TestValidatePodForeignImages(t *testing.T) {
+
+	wh := mutationWH{
+		allowedRegistries: []string{"harbor.corp"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "harbor.corp/a:v"},
+				{Name: "sidecar", Image: "quay.io/b:v"},
+			},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox"}},
+			},
+		},
+	}
+
+	err := wh.validatePod(pod)
+	assert.NotNil(t, err)
+	assert.IsType(t, &forbiddenError{}, err)
+	assert.Equal(t, `container "sidecar" image "quay.io/b:v", container "debugger" image "busybox" not pulled from an allowed registry (harbor.corp)`, err.Error())
+}
+
+func TestValidatePodDefaultsToMutationRegistries(t *testing.T) {
+
+	wh := mutationWH{
+		registry:          "harbor.corp/default",
+		registryMapping:   map[string]string{"quay.io": "harbor.corp/quay"},
+		ignoredRegistries: []string{"docker.sqooba.io/local"},
+	}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "a", Image: "harbor.corp/default/a:v"},
+				{Name: "b", Image: "harbor.corp/quay/b:v"},
+				{Name: "c", Image: "docker.sqooba.io/local/c:v"},
+			},
+		},
+	}
+	assert.Nil(t, wh.validatePod(pod))
+
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "d", Image: "harbor.corp/other/d:v"})
+	assert.NotNil(t, wh.validatePod(pod))
+}
+
+func TestValidatePodNothingConfigured(t *testing.T) {
+
+	wh := mutationWH{}
+
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "a", Image: "quay.io/a:v"},
+			},
+		},
+	}
+	assert.Nil(t, wh.validatePod(pod))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var (
+	deploymentResource  = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	statefulSetResource = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+	daemonSetResource   = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}
+	jobResource         = metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	cronJobResource     = metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}
+)
+
+const (
+	// podTemplatePath is the path of the pod template in deployments, statefulsets, daemonsets and jobs.
+	podTemplatePath = "/spec/template"
+	// cronJobPodTemplatePath is the path of the pod template in cronjobs.
+	cronJobPodTemplatePath = "/spec/jobTemplate/spec/template"
+)
+
+// isWorkloadResource returns true if the resource is a workload embedding a pod template.
+func isWorkloadResource(resource metav1.GroupVersionResource) bool {
+	switch resource {
+	case deploymentResource, statefulSetResource, daemonSetResource, jobResource, cronJobResource:
+		return true
+	}
+	return false
+}
+
+// applyMutationOnWorkload deserializes the workload of the request and returns the patch operations
+// to apply on its pod template, if any, or an error if something went wrong. This way, the workloads
+// are stored with the same images and policies as the pods they create.
+// The volume claim templates of statefulsets are mutated even if the mutation of workloads is disabled,
+// as the storage class policy applies to the pvcs they create.
+func (wh *mutationWH) applyMutationOnWorkload(req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+
+	if !wh.mutateWorkloads && req.Resource != statefulSetResource {
+		log.Debugf("Mutation of workloads is disabled, skipping %s", req.Resource)
+		return nil, nil
+	}
+
+	switch req.Resource {
+	case deploymentResource:
+		deployment, old := appsv1.Deployment{}, appsv1.Deployment{}
+		if err := decodeWorkload(req, &deployment, &old); err != nil {
+			return nil, fmt.Errorf("could not deserialize deployment object: %v", err)
+		}
+		return wh.applyMutationOnPodTemplate(deployment.Spec.Template, oldPodSpec(req, old.Spec.Template), req.Namespace, podTemplatePath)
+
+	case statefulSetResource:
+		statefulSet, old := appsv1.StatefulSet{}, appsv1.StatefulSet{}
+		if err := decodeWorkload(req, &statefulSet, &old); err != nil {
+			return nil, fmt.Errorf("could not deserialize statefulset object: %v", err)
+		}
+		return wh.applyMutationOnStatefulSet(statefulSet, oldPodSpec(req, old.Spec.Template), req.Namespace, req.Operation)
+
+	case daemonSetResource:
+		daemonSet, old := appsv1.DaemonSet{}, appsv1.DaemonSet{}
+		if err := decodeWorkload(req, &daemonSet, &old); err != nil {
+			return nil, fmt.Errorf("could not deserialize daemonset object: %v", err)
+		}
+		return wh.applyMutationOnPodTemplate(daemonSet.Spec.Template, oldPodSpec(req, old.Spec.Template), req.Namespace, podTemplatePath)
+
+	case jobResource:
+		// The pod template of a job cannot be updated: patching it would deny every update of a job
+		// created with another configuration, such as the removal of its finalizers.
+		if req.Operation == admissionv1.Update {
+			log.Debugf("The pod template of job %s/%s is immutable, not mutating it on update", req.Namespace, req.Name)
+			return nil, nil
+		}
+		job := batchv1.Job{}
+		if _, _, err := universalDeserializer.Decode(req.Object.Raw, nil, &job); err != nil {
+			return nil, fmt.Errorf("could not deserialize job object: %v", err)
+		}
+		return wh.applyMutationOnPodTemplate(job.Spec.Template, nil, req.Namespace, podTemplatePath)
+
+	case cronJobResource:
+		cronJob, old := batchv1.CronJob{}, batchv1.CronJob{}
+		if err := decodeWorkload(req, &cronJob, &old); err != nil {
+			return nil, fmt.Errorf("could not deserialize cronjob object: %v", err)
+		}
+		return wh.applyMutationOnPodTemplate(cronJob.Spec.JobTemplate.Spec.Template, oldPodSpec(req, old.Spec.JobTemplate.Spec.Template),
+			req.Namespace, cronJobPodTemplatePath)
+	}
+
+	log.Printf("Got an unexpected workload resource %s, don't know what to do with...", req.Resource)
+	return nil, nil
+}
+
+// decodeWorkload deserializes the object of the request into obj, and its old object into old on update.
+func decodeWorkload(req *admissionv1.AdmissionRequest, obj runtime.Object, old runtime.Object) error {
+	if _, _, err := universalDeserializer.Decode(req.Object.Raw, nil, obj); err != nil {
+		return err
+	}
+	if req.Operation != admissionv1.Update || len(req.OldObject.Raw) == 0 {
+		return nil
+	}
+	_, _, err := universalDeserializer.Decode(req.OldObject.Raw, nil, old)
+	return err
+}
+
+// oldPodSpec returns the spec of the given pod template of the old object of the request on update, nil otherwise.
+func oldPodSpec(req *admissionv1.AdmissionRequest, template corev1.PodTemplateSpec) *corev1.PodSpec {
+	if req.Operation != admissionv1.Update {
+		return nil
+	}
+	return &template.Spec
+}
+
+// applyMutationOnPodTemplate returns the patch operations to apply on the given pod template of a workload
+// of the given namespace, given the spec of the template of the old workload on update.
+// The annotations of the template are honoured, as the ones of the pods it creates.
+func (wh *mutationWH) applyMutationOnPodTemplate(template corev1.PodTemplateSpec, old *corev1.PodSpec, namespace string, path string) ([]patchOperation, error) {
+	meta := template.ObjectMeta
+	meta.Namespace = namespace
+	return wh.applyMutationOnPodSpec(meta, template.Spec, old, path)
+}
+
+// applyMutationOnStatefulSet returns the patch operations to apply on the pod template of the statefulset,
+// if the mutation of workloads is enabled, and on its volume claim templates, on creation only, as they
+// cannot be updated: patching them would deny every update of a statefulset created with another storage class.
+func (wh *mutationWH) applyMutationOnStatefulSet(statefulSet appsv1.StatefulSet, old *corev1.PodSpec, namespace string, operation admissionv1.Operation) ([]patchOperation, error) {
+
+	var patches []patchOperation
+
+	if wh.mutateWorkloads {
+		var err error
+		if patches, err = wh.applyMutationOnPodTemplate(statefulSet.Spec.Template, old, namespace, podTemplatePath); err != nil {
+			return nil, err
+		}
+	}
+
+	if operation == admissionv1.Update {
+		log.Debugf("Patch applied: %v", patches)
+		return patches, nil
+	}
+
+	for i, t := range statefulSet.Spec.VolumeClaimTemplates {
+		// The pvcs created from the template get its annotations, honour them as for pvcs.
+		meta := t.ObjectMeta
+		meta.Namespace = namespace
+		if wh.mutationOptions(meta).skip {
+			continue
+		}
+		patches = append(patches, wh.applyMutationOnPvcSpec(t.Spec, fmt.Sprintf("/spec/volumeClaimTemplates/%d/spec", i))...)
+	}
+
+	log.Debugf("Patch applied: %v", patches)
+
+	return patches, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func workloadRequest(t *testing.T, obj interface{}, resource metav1.GroupVersionResource) *admissionv1.AdmissionRequest {
+	raw, err := json.Marshal(obj)
+	assert.Nil(t, err)
+
+	return &admissionv1.AdmissionRequest{
+		Resource: resource,
+		Object:   runtime.RawExtension{Raw: raw},
+	}
+}
+
+func updateRequest(t *testing.T, obj interface{}, old interface{}, resource metav1.GroupVersionResource) *admissionv1.AdmissionRequest {
+	req := workloadRequest(t, obj, resource)
+	raw, err := json.Marshal(old)
+	assert.Nil(t, err)
+
+	req.Operation = admissionv1.Update
+	req.OldObject = runtime.RawExtension{Raw: raw}
+	return req
+}
+
+func TestDeploymentNotMutatedByDefault(t *testing.T) {
+
+	wh := mutationWH{
+		registry: "x.y",
+	}
+
+	deployment := appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Image: "a:v"},
+					},
+				},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutations(workloadRequest(t, deployment, deploymentResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
+func TestDeployment(t *testing.T) {
+
+	wh := mutationWH{
+		registry:        "x.y",
+		imagePullSecret: "s1",
+		mutateWorkloads: true,
+	}
+
+	deployment := appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{Image: "a:v"},
+					},
+					Containers: []corev1.Container{
+						{Image: "b/c:v"},
+					},
+				},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutations(workloadRequest(t, deployment, deploymentResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(patches))
+	assert.Equal(t, "/spec/template/spec/initContainers/0/image", patches[0].Path)
+	assert.Equal(t, "x.y/a:v", patches[0].Value)
+	assert.Equal(t, "/spec/template/spec/containers/0/image", patches[1].Path)
+	assert.Equal(t, "x.y/b/c:v", patches[1].Value)
+	assert.Equal(t, "add", patches[2].Op)
+	assert.Equal(t, "/spec/template/spec/imagePullSecrets", patches[2].Path)
+}
+
+func TestStatefulSet(t *testing.T) {
+
+	wh := mutationWH{
+		forceImagePullPolicy:   true,
+		imagePullPolicyToForce: corev1.PullAlways,
+		mutateWorkloads:        true,
+	}
+
+	statefulSet := appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Image: "a:v", ImagePullPolicy: corev1.PullIfNotPresent},
+					},
+				},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutations(workloadRequest(t, statefulSet, statefulSetResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "replace", patches[0].Op)
+	assert.Equal(t, "/spec/template/spec/containers/0/imagePullPolicy", patches[0].Path)
+	assert.Equal(t, corev1.PullAlways, patches[0].Value)
+}
+
+func TestCronJob(t *testing.T) {
+
+	wh := mutationWH{
+		registry:        "x.y",
+		mutateWorkloads: true,
+	}
+
+	cronJob := batchv1.CronJob{
+		Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{Image: "a:v"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutations(workloadRequest(t, cronJob, cronJobResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "replace", patches[0].Op)
+	assert.Equal(t, "/spec/jobTemplate/spec/template/spec/containers/0/image", patches[0].Path)
+	assert.Equal(t, "x.y/a:v", patches[0].Value)
+}
+
+func TestJob(t *testing.T) {
+
+	wh := mutationWH{
+		registry:        "x.y",
+		mutateWorkloads: true,
+	}
+
+	job := batchv1.Job{
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Image: "a:v"},
+					},
+				},
+			},
+		},
+	}
+
+	patches, err := wh.applyMutations(workloadRequest(t, job, jobResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "/spec/template/spec/containers/0/image", patches[0].Path)
+
+	// The pod template of a job is immutable, it is not mutated on update.
+	updated := job
+	updated.Labels = map[string]string{"a": "b"}
+	patches, err = wh.applyMutations(updateRequest(t, updated, job, jobResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(patches))
+}
+
+func TestStatefulSetVolumeClaimTemplates(t *testing.T) {
+
+	wh := mutationWH{
+		registry:            "x.y",
+		defaultStorageClass: storageClass1,
+	}
+
+	statefulSet := appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Image: "a:v"},
+					},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{Spec: corev1.PersistentVolumeClaimSpec{}},
+				{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass1}},
+				{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass2}},
+			},
+		},
+	}
+
+	// The pod template is not mutated, as the mutation of workloads is disabled.
+	patches, err := wh.applyMutations(workloadRequest(t, statefulSet, statefulSetResource))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(patches))
+	assert.Equal(t, "add", patches[0].Op)
+	assert.Equal(t, "/spec/volumeClaimTemplates/0/spec/storageClassName", patches[0].Path)
+	assert.Equal(t, storageClass1, patches[0].Value)
+	assert.Equal(t, "replace", patches[1].Op)
+	assert.Equal(t, "/spec/volumeClaimTemplates/2/spec/storageClassName", patches[1].Path)
+	assert.Equal(t, storageClass1, patches[1].Value)
+}
+
+func TestStatefulSetVolumeClaimTemplatesNotMutatedOnUpdate(t *testing.T) {
+
+	wh := mutationWH{
+		registry:            "x.y",
+		defaultStorageClass: storageClass1,
+		mutateWorkloads:     true,
+	}
+
+	statefulSet := appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Image: "a:v"},
+					},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass2}},
+			},
+		},
+	}
+
+	// The volume claim templates are immutable, only the pod template is mutated on update.
+	req := workloadRequest(t, statefulSet, statefulSetResource)
+	req.Operation = admissionv1.Update
+	patches, err := wh.applyMutations(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "/spec/template/spec/containers/0/image", patches[0].Path)
+
+	req.Operation = admissionv1.Create
+	patches, err = wh.applyMutations(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(patches))
+	assert.Equal(t, "/spec/volumeClaimTemplates/0/spec/storageClassName", patches[1].Path)
+}